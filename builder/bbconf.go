@@ -0,0 +1,359 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Conf is a parsed BitBake configuration file, together with the files it
+// includes and requires. Only the assignment syntax used in conf files is
+// supported, not recipes or python functions.
+type Conf struct {
+	vars map[string]*Variable
+	// Files lists every file read, starting with the parsed file
+	Files []string
+	// Annotations are the "# /// KEY=value" comments of the parsed file,
+	// those of included files are ignored
+	Annotations map[string]string
+}
+
+// Variable is a variable of a Conf
+type Variable struct {
+	Name     string
+	Exported bool
+	// File and Line tell where the variable was last assigned
+	File string
+	Line int
+
+	value       string
+	set         bool
+	weakDefault string
+	hasWeak     bool
+	overrides   []override
+}
+
+// override is an :append, :prepend or :remove of a variable. They are
+// applied when the value is read, after all other assignments.
+type override struct {
+	op    string
+	value string
+}
+
+// ConfError is returned for syntax errors and missing required files
+type ConfError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ConfError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+var (
+	confAssignRe = regexp.MustCompile(`^(export\s+)?([A-Za-z0-9_\-\.\+/${}:~]+?)(\[[A-Za-z0-9_\-]+\])?\s*(\?\?=|\?=|:=|\+=|=\+|\.=|=\.|=)\s*(.*)$`)
+	confExportRe = regexp.MustCompile(`^export\s+([A-Za-z0-9_\-]+)$`)
+	confUnsetRe  = regexp.MustCompile(`^unset\s+([A-Za-z0-9_\-]+)$`)
+	confIncRe    = regexp.MustCompile(`^(include|require)\s+(.+)$`)
+	annotationRe = regexp.MustCompile(`^#\s*///\s*([A-Za-z0-9_]+)=(.*)$`)
+	expandRe     = regexp.MustCompile(`\$\{([A-Za-z0-9_\-\.\+/:~]+)\}`)
+	overrideRe   = regexp.MustCompile(`^(.+?)(?::|_)(append|prepend|remove)$`)
+)
+
+// The deepest include chain we follow before assuming a loop
+const maxIncludeDepth = 20
+
+// ParseConf parses the conf file at path. Files included or required with
+// a relative path are looked up in each directory of bbpath, like BitBake
+// does with BBPATH, and then next to the including file.
+func ParseConf(path string, bbpath []string) (*Conf, error) {
+	c := &Conf{vars: map[string]*Variable{}, Annotations: map[string]string{}}
+	if err := c.parseFile(path, bbpath, 0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conf) parseFile(path string, bbpath []string, depth int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c.Files = append(c.Files, path)
+
+	var (
+		scanner = bufio.NewScanner(f)
+		lineNo  int
+		start   int
+		logical string
+	)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if logical == "" {
+			start = lineNo
+		}
+		// A backslash at the end continues the line
+		if strings.HasSuffix(line, "\\") {
+			logical += strings.TrimSuffix(line, "\\")
+			continue
+		}
+		logical += line
+		stmt := strings.TrimSpace(logical)
+		logical = ""
+
+		if err = c.parseStatement(stmt, path, start, bbpath, depth); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if logical != "" {
+		return &ConfError{path, start, "unterminated line continuation"}
+	}
+	return nil
+}
+
+func (c *Conf) parseStatement(stmt, file string, line int, bbpath []string, depth int) error {
+	if stmt == "" {
+		return nil
+	}
+	if strings.HasPrefix(stmt, "#") {
+		// Only the header of the parsed file annotates it, not the files
+		// it includes
+		if m := annotationRe.FindStringSubmatch(stmt); m != nil && depth == 0 {
+			c.Annotations[m[1]] = strings.TrimSpace(m[2])
+		}
+		return nil
+	}
+	if m := confIncRe.FindStringSubmatch(stmt); m != nil {
+		return c.include(m[1] == "require", c.expand(strings.TrimSpace(m[2]), nil), file, line, bbpath, depth)
+	}
+	if m := confExportRe.FindStringSubmatch(stmt); m != nil {
+		c.variable(m[1]).Exported = true
+		return nil
+	}
+	if m := confUnsetRe.FindStringSubmatch(stmt); m != nil {
+		delete(c.vars, m[1])
+		return nil
+	}
+	m := confAssignRe.FindStringSubmatch(stmt)
+	if m == nil {
+		return &ConfError{file, line, fmt.Sprintf("can't parse %q", stmt)}
+	}
+	if m[3] != "" {
+		// Variable flags, e.g. VAR[doc], are not part of the value
+		return nil
+	}
+	value, err := unquote(m[5])
+	if err != nil {
+		return &ConfError{file, line, err.Error()}
+	}
+	c.assign(m[2], m[4], value, m[1] != "", file, line)
+	return nil
+}
+
+// unquote returns the value of a quoted string
+func unquote(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1], nil
+	}
+	return "", fmt.Errorf("value %s is not quoted", s)
+}
+
+func (c *Conf) variable(name string) *Variable {
+	v, ok := c.vars[name]
+	if !ok {
+		v = &Variable{Name: name}
+		c.vars[name] = v
+	}
+	return v
+}
+
+func (c *Conf) assign(name, op, value string, export bool, file string, line int) {
+	if m := overrideRe.FindStringSubmatch(name); m != nil && op == "=" {
+		v := c.variable(m[1])
+		v.overrides = append(v.overrides, override{op: m[2], value: value})
+		return
+	}
+
+	v := c.variable(name)
+	v.Exported = v.Exported || export
+	switch op {
+	case "??=":
+		// The last weak default wins
+		v.weakDefault, v.hasWeak = value, true
+		return
+	case "?=":
+		if v.set {
+			return
+		}
+		v.value = value
+	case ":=":
+		v.value = c.expand(value, nil)
+	case "=":
+		v.value = value
+	case "+=":
+		v.value = joinNonEmpty(c.current(v), value, " ")
+	case "=+":
+		v.value = joinNonEmpty(value, c.current(v), " ")
+	case ".=":
+		v.value = c.current(v) + value
+	case "=.":
+		v.value = value + c.current(v)
+	}
+	v.set = true
+	v.File, v.Line = file, line
+}
+
+// current is the value a variable has before an append or prepend
+func (c *Conf) current(v *Variable) string {
+	if v.set {
+		return v.value
+	}
+	return ""
+}
+
+func joinNonEmpty(a, b, sep string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + sep + b
+}
+
+func (c *Conf) include(required bool, name, file string, line int, bbpath []string, depth int) error {
+	if depth >= maxIncludeDepth {
+		return &ConfError{file, line, fmt.Sprintf("includes nested too deep including %s, is there a loop?", name)}
+	}
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = nil
+		for _, dir := range bbpath {
+			candidates = append(candidates, filepath.Join(dir, name))
+		}
+		candidates = append(candidates, filepath.Join(filepath.Dir(file), name))
+	}
+	for _, p := range candidates {
+		if _, err := os.Stat(p); err == nil {
+			return c.parseFile(p, bbpath, depth+1)
+		}
+	}
+	if required {
+		return &ConfError{file, line, fmt.Sprintf("could not find required file %s", name)}
+	}
+	log.Printf("%s:%d: include file %s not found, skipping it", file, line, name)
+	return nil
+}
+
+// expand replaces ${VAR} references in s with the values of the
+// variables. References to unknown variables are kept as they are, like
+// BitBake does. seen is used to stop recursive references.
+func (c *Conf) expand(s string, seen map[string]bool) string {
+	return expandRe.ReplaceAllStringFunc(s, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		if seen[name] {
+			return ref
+		}
+		if _, ok := c.vars[name]; !ok {
+			return ref
+		}
+		next := map[string]bool{name: true}
+		for n := range seen {
+			next[n] = true
+		}
+		return c.value(name, next)
+	})
+}
+
+// value returns the final, expanded value of a variable
+func (c *Conf) value(name string, seen map[string]bool) string {
+	v, ok := c.vars[name]
+	if !ok {
+		return ""
+	}
+	val := v.value
+	if !v.set && v.hasWeak {
+		val = v.weakDefault
+	}
+	for _, o := range v.overrides {
+		switch o.op {
+		case "append":
+			val += o.value
+		case "prepend":
+			val = o.value + val
+		}
+	}
+	for _, o := range v.overrides {
+		if o.op == "remove" {
+			remove := map[string]bool{}
+			for _, w := range strings.Fields(c.expand(o.value, seen)) {
+				remove[w] = true
+			}
+			var kept []string
+			for _, w := range strings.Fields(val) {
+				if !remove[w] {
+					kept = append(kept, w)
+				}
+			}
+			val = strings.Join(kept, " ")
+		}
+	}
+	return c.expand(val, seen)
+}
+
+// Get returns the expanded value of a variable, or "" if it is not set
+func (c *Conf) Get(name string) string {
+	return c.value(name, map[string]bool{name: true})
+}
+
+// IsSet returns true if the variable has been given a value
+func (c *Conf) IsSet(name string) bool {
+	v, ok := c.vars[name]
+	return ok && (v.set || v.hasWeak || len(v.overrides) > 0)
+}
+
+// Variable returns the variable name, or nil if it doesn't exist
+func (c *Conf) Variable(name string) *Variable {
+	return c.vars[name]
+}
+
+// Names returns the names of all set variables, sorted
+func (c *Conf) Names() []string {
+	var names []string
+	for n := range c.vars {
+		if c.IsSet(n) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
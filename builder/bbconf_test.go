@@ -0,0 +1,229 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parseTestConf writes files to a temporary directory and parses the
+// main.conf among them, with the directory as bbpath
+func parseTestConf(t *testing.T, files map[string]string) (*Conf, error) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tcb-bbconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ParseConf(filepath.Join(dir, "main.conf"), []string{dir})
+}
+
+func TestParseConf(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  map[string]string
+	}{
+		{
+			name:  "assign",
+			files: map[string]string{"main.conf": "A = \"1\"\nA = \"2\"\nB = '${A} x'\n"},
+			want:  map[string]string{"A": "2", "B": "2 x"},
+		},
+		{
+			name:  "default",
+			files: map[string]string{"main.conf": "A ?= \"1\"\nA ?= \"2\"\nB = \"1\"\nB ?= \"2\"\n"},
+			want:  map[string]string{"A": "1", "B": "1"},
+		},
+		{
+			name:  "weak default",
+			files: map[string]string{"main.conf": "A ??= \"1\"\nA ??= \"2\"\nB ??= \"1\"\nB = \"3\"\nC ??= \"1\"\nC ?= \"4\"\n"},
+			want:  map[string]string{"A": "2", "B": "3", "C": "4"},
+		},
+		{
+			name:  "immediate",
+			files: map[string]string{"main.conf": "A = \"1\"\nB := \"${A}\"\nC = \"${A}\"\nA = \"2\"\n"},
+			want:  map[string]string{"B": "1", "C": "2"},
+		},
+		{
+			name:  "append with space",
+			files: map[string]string{"main.conf": "A = \"1\"\nA += \"2\"\nB += \"3\"\n"},
+			want:  map[string]string{"A": "1 2", "B": "3"},
+		},
+		{
+			name:  "prepend with space",
+			files: map[string]string{"main.conf": "A = \"1\"\nA =+ \"2\"\n"},
+			want:  map[string]string{"A": "2 1"},
+		},
+		{
+			name:  "append without space",
+			files: map[string]string{"main.conf": "A = \"1\"\nA .= \"2\"\n"},
+			want:  map[string]string{"A": "12"},
+		},
+		{
+			name:  "prepend without space",
+			files: map[string]string{"main.conf": "A = \"1\"\nA =. \"2\"\n"},
+			want:  map[string]string{"A": "21"},
+		},
+		{
+			name:  "append override",
+			files: map[string]string{"main.conf": "A_append = \" 2\"\nA:append = \" 3\"\nA = \"1\"\n"},
+			want:  map[string]string{"A": "1 2 3"},
+		},
+		{
+			name:  "prepend override",
+			files: map[string]string{"main.conf": "A_prepend = \"0 \"\nA = \"1\"\n"},
+			want:  map[string]string{"A": "0 1"},
+		},
+		{
+			name:  "remove override",
+			files: map[string]string{"main.conf": "R = \"b\"\nA = \"a b c b\"\nA:remove = \"${R} c\"\nA_append = \" c d\"\n"},
+			want:  map[string]string{"A": "a d"},
+		},
+		{
+			name:  "export and unset",
+			files: map[string]string{"main.conf": "export A = \"1\"\nB = \"2\"\nunset B\n"},
+			want:  map[string]string{"A": "1", "B": ""},
+		},
+		{
+			name:  "flags",
+			files: map[string]string{"main.conf": "A = \"1\"\nA[doc] = \"the doc\"\n"},
+			want:  map[string]string{"A": "1"},
+		},
+		{
+			name:  "continuation",
+			files: map[string]string{"main.conf": "A = \"1 \\\n  2 \\\n  3\"\nB = \"4\"\n"},
+			want:  map[string]string{"A": "1   2   3", "B": "4"},
+		},
+		{
+			name: "include",
+			files: map[string]string{
+				"main.conf":      "A = \"1\"\ninclude inc/common.inc\ninclude missing.inc\nB += \"main\"\n",
+				"inc/common.inc": "A = \"2\"\nB = \"inc\"\ninclude nested.inc\n",
+				"inc/nested.inc": "C = \"next to the including file\"\n",
+			},
+			want: map[string]string{"A": "2", "B": "inc main", "C": "next to the including file"},
+		},
+		{
+			name: "require",
+			files: map[string]string{
+				"main.conf": "require ${NAME}.inc\n",
+				"x.inc":     "A = \"required\"\n",
+			},
+			// NAME is unknown, so the reference is kept, and the file not found
+			want: nil,
+		},
+		{
+			name: "require expanded",
+			files: map[string]string{
+				"main.conf": "NAME = \"x\"\nrequire ${NAME}.inc\nA .= \" after\"\n",
+				"x.inc":     "A = \"required\"\n",
+			},
+			want: map[string]string{"A": "required after"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := parseTestConf(t, tt.files)
+			if tt.want == nil {
+				if _, ok := err.(*ConfError); !ok {
+					t.Fatalf("ParseConf = %v, want a ConfError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseConf: %v", err)
+			}
+			for name, want := range tt.want {
+				if got := conf.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfErrors(t *testing.T) {
+	tests := map[string]string{
+		"syntax":       "A \"1\"\n",
+		"unquoted":     "A = 1\n",
+		"continuation": "A = \"1 \\\n",
+		"loop":         "include main.conf\n",
+		"require":      "require missing.inc\n",
+	}
+	for name, content := range tests {
+		if _, err := parseTestConf(t, map[string]string{"main.conf": content}); err == nil {
+			t.Errorf("%s: ParseConf succeeded", name)
+		} else if _, ok := err.(*ConfError); !ok {
+			t.Errorf("%s: ParseConf = %v, want a ConfError", name, err)
+		}
+	}
+}
+
+func TestParseConfAnnotations(t *testing.T) {
+	conf, err := parseTestConf(t, map[string]string{
+		"main.conf":  "# /// DEPENDENCIES=native\n# ///DESCRIPTION= a cross compiler \nrequire common.inc\n",
+		"common.inc": "# /// DEPENDENCIES=\n# /// OTHER=x\n",
+	})
+	if err != nil {
+		t.Fatalf("ParseConf: %v", err)
+	}
+	want := map[string]string{"DEPENDENCIES": "native", "DESCRIPTION": "a cross compiler"}
+	if len(conf.Annotations) != len(want) {
+		t.Errorf("Annotations = %v, want %v", conf.Annotations, want)
+	}
+	for k, v := range want {
+		if conf.Annotations[k] != v {
+			t.Errorf("Annotations[%s] = %q, want %q", k, conf.Annotations[k], v)
+		}
+	}
+	if len(conf.Files) != 2 {
+		t.Errorf("Files = %v, want main.conf and common.inc", conf.Files)
+	}
+}
+
+func TestParseConfVariable(t *testing.T) {
+	conf, err := parseTestConf(t, map[string]string{"main.conf": "A = \"1\"\n\nexport A\nB ??= \"2\"\n"})
+	if err != nil {
+		t.Fatalf("ParseConf: %v", err)
+	}
+	v := conf.Variable("A")
+	if v == nil || !v.Exported || filepath.Base(v.File) != "main.conf" || v.Line != 1 {
+		t.Errorf("Variable(A) = %+v", v)
+	}
+	if !conf.IsSet("B") || conf.IsSet("C") {
+		t.Errorf("IsSet(B) = %t, IsSet(C) = %t", conf.IsSet("B"), conf.IsSet("C"))
+	}
+	if names := conf.Names(); len(names) != 2 || names[0] != "A" || names[1] != "B" {
+		t.Errorf("Names() = %v", names)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/staffano/tcb/container"
+	"github.com/staffano/tcb/git"
+	"github.com/staffano/tcb/workspace"
+)
+
+// The entries of a bundle archive. The git layers are in bundleLayers, as
+// <name>.bundle.
+const (
+	bundleManifest  = "manifest.json"
+	bundleImage     = "image.tar"
+	bundleDownloads = "downloads.tar"
+	bundleLayers    = "layers"
+)
+
+// Bundle describes a bundle archive, which carries what the builds need to
+// a host without network access
+type Bundle struct {
+	// Image is the tag of the builder image. The native runtime has none.
+	Image string `json:"image,omitempty"`
+	// Layers are the git layers and the commits they were at
+	Layers []LockedLayer `json:"layers"`
+}
+
+// ExportBundle writes the builder image, the contents of the downloads
+// volume and git bundles of the git layers to the archive file. The
+// builder image must have been built.
+func ExportBundle(file string) (*Bundle, error) {
+	layers, err := Layers()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(workspace.Path(), "bundle-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	b := &Bundle{}
+	entries := []string{bundleManifest}
+	if err = os.Mkdir(filepath.Join(tmp, bundleLayers), 0755); err != nil {
+		return nil, err
+	}
+	for _, l := range layers {
+		if l.Path != "" {
+			log.Printf("Not bundling %s, it is a local layer", l.Name)
+			continue
+		}
+		commit, err := git.Head(l.Dir())
+		if err != nil {
+			return nil, err
+		}
+		entry := path.Join(bundleLayers, l.Name+".bundle")
+		if err = git.CreateBundle(l.Dir(), filepath.Join(tmp, entry)); err != nil {
+			return nil, err
+		}
+		b.Layers = append(b.Layers, LockedLayer{Name: l.Name, URL: git.Redact(l.URL), Commit: commit})
+		entries = append(entries, entry)
+	}
+
+	tag, err := ImageTag()
+	if err != nil {
+		return nil, err
+	}
+	id, err := container.ImageID(tag)
+	if err != nil {
+		return nil, fmt.Errorf("the builder image %s must be built first: %w", tag, err)
+	}
+	if id != "" {
+		b.Image = tag
+		if err = saveImage(tag, filepath.Join(tmp, bundleImage)); err != nil {
+			return nil, err
+		}
+		entries = append(entries, bundleImage)
+	}
+	if err = container.ExportDownloads(tag, filepath.Join(tmp, bundleDownloads)); err != nil {
+		return nil, err
+	}
+	entries = append(entries, bundleDownloads)
+
+	manifest, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(tmp, bundleManifest), append(manifest, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	if err = writeArchive(file, tmp, entries); err != nil {
+		return nil, fmt.Errorf("writing %s: %w", file, err)
+	}
+	return b, nil
+}
+
+func saveImage(tag, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err = container.SaveImage(tag, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeArchive writes the entries, files relative to dir, to the tar
+// archive file
+func writeArchive(file, dir string, entries []string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, entry := range entries {
+		src, err := os.Open(filepath.Join(dir, filepath.FromSlash(entry)))
+		if err != nil {
+			return err
+		}
+		fi, err := src.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: entry, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+		if err == nil {
+			_, err = io.Copy(tw, src)
+		}
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readArchive extracts the archive file into dir
+func readArchive(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || path.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return fmt.Errorf("unexpected entry %s", hdr.Name)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ImportBundle restores the builder image, the downloads and the layers of
+// a bundle written by ExportBundle. The layers are checked out at the
+// commits they were exported at, and layers not configured here, or
+// configured as local layers, are skipped.
+func ImportBundle(file string) (*Bundle, error) {
+	tmp, err := ioutil.TempDir(workspace.Path(), "bundle-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err = readArchive(file, tmp); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+	b := &Bundle{}
+	manifest, err := ioutil.ReadFile(filepath.Join(tmp, bundleManifest))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a tcb bundle: %w", file, err)
+	}
+	if err = json.Unmarshal(manifest, b); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+
+	if b.Image != "" {
+		f, err := os.Open(filepath.Join(tmp, bundleImage))
+		if err != nil {
+			return nil, err
+		}
+		err = container.LoadImage(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if tag, err := ImageTag(); err == nil && tag != b.Image {
+			log.Printf("Warning: the bundle has the builder image %s, but the config here gives %s", b.Image, tag)
+		}
+	}
+	if err = container.ImportDownloads(b.Image, filepath.Join(tmp, bundleDownloads)); err != nil {
+		return nil, err
+	}
+
+	layers, err := Layers()
+	if err != nil {
+		return nil, err
+	}
+	for _, locked := range b.Layers {
+		var layer *Layer
+		for i := range layers {
+			if layers[i].Name == locked.Name {
+				layer = &layers[i]
+			}
+		}
+		if layer == nil || layer.Path != "" {
+			log.Printf("Skipping layer %s, it is not a git layer here", locked.Name)
+			continue
+		}
+		bundle := filepath.Join(tmp, bundleLayers, locked.Name+".bundle")
+		if err = git.FetchBundle(layer.Dir(), bundle, layer.URL); err != nil {
+			return nil, err
+		}
+		if _, err = git.Checkout(layer.Dir(), locked.Commit); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
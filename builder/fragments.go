@@ -0,0 +1,85 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/staffano/tcb/workspace"
+)
+
+// SiteConf is the name of the conf file in the workspace appended to the
+// local.conf of every target
+const SiteConf = "site.conf"
+
+// Fragment is a piece of configuration appended to local.conf
+type Fragment struct {
+	// Source tells where the fragment came from
+	Source  string
+	Content string
+}
+
+// Fragments returns the user supplied configuration of target, in the
+// order it is appended to local.conf:
+//
+//  1. site.conf in the workspace
+//  2. the local_conf_append list of the config file
+//  3. the targets.<target>.local_conf_append list of the config file
+//
+// Later fragments win over earlier ones. The --set and --append overrides
+// are appended after all of them.
+func Fragments(target string) ([]Fragment, error) {
+	var res []Fragment
+
+	site := workspace.Path(SiteConf)
+	content, err := ioutil.ReadFile(site)
+	if err == nil {
+		res = append(res, Fragment{Source: site, Content: string(content)})
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading %s: %w", site, err)
+	}
+
+	for _, key := range []string{"local_conf_append", "targets." + target + ".local_conf_append"} {
+		lines := viper.GetStringSlice(key)
+		if len(lines) > 0 {
+			res = append(res, Fragment{Source: "config " + key, Content: strings.Join(lines, "\n")})
+		}
+	}
+	return res, nil
+}
+
+// fragmentConf returns the local.conf lines of the fragments, each headed
+// by a comment telling where it came from
+func fragmentConf(fragments []Fragment) string {
+	var b strings.Builder
+	for _, f := range fragments {
+		fmt.Fprintf(&b, "\n# From %s\n%s", f.Source, f.Content)
+		if !strings.HasSuffix(f.Content, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
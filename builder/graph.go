@@ -0,0 +1,158 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Graph holds the dependencies between all targets in conf/toolchains
+type Graph struct {
+	deps map[string][]string
+}
+
+// CycleError is returned when targets depend on each other in a circle.
+// Cycle starts and ends with the same target.
+type CycleError struct {
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return "dependency cycle: " + strings.Join(e.Cycle, " -> ")
+}
+
+// MissingDependencyError is returned when a target depends on a target that
+// has no conf file.
+type MissingDependencyError struct {
+	Target     string
+	Dependency string
+}
+
+func (e *MissingDependencyError) Error() string {
+	return fmt.Sprintf("%s depends on %s, which is not a known target", e.Target, e.Dependency)
+}
+
+// LoadGraph reads the dependencies of all targets and verifies that they
+// form a DAG.
+func LoadGraph() (*Graph, error) {
+	g := &Graph{deps: map[string][]string{}}
+	targets, err := GetAllTargets()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		deps, err := GetDependencies(t)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(deps)
+		g.deps[t] = deps
+	}
+	for _, t := range g.Targets() {
+		for _, d := range g.deps[t] {
+			if _, ok := g.deps[d]; !ok {
+				return nil, &MissingDependencyError{Target: t, Dependency: d}
+			}
+		}
+	}
+	if _, err := g.Order(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Targets returns all targets in the graph, sorted by name
+func (g *Graph) Targets() []string {
+	var res []string
+	for t := range g.deps {
+		res = append(res, t)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Dependencies returns the targets target directly depends on
+func (g *Graph) Dependencies(target string) []string {
+	return g.deps[target]
+}
+
+// Order returns targets and everything they depend on, sorted so each
+// target comes after its dependencies. Targets that don't depend on each
+// other are ordered by name, so the order is the same from run to run. If
+// no targets are given, or the only one is "all", all targets are ordered.
+func (g *Graph) Order(targets ...string) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	var (
+		order []string
+		path  []string
+		state = map[string]int{}
+	)
+
+	if len(targets) == 0 || (len(targets) == 1 && targets[0] == "all") {
+		targets = g.Targets()
+	}
+
+	var visit func(t string) error
+	visit = func(t string) error {
+		switch state[t] {
+		case done:
+			return nil
+		case visiting:
+			// Cut the path at the first occurrence of t to get the cycle
+			for i := range path {
+				if path[i] == t {
+					cycle := append([]string{}, path[i:]...)
+					return &CycleError{Cycle: append(cycle, t)}
+				}
+			}
+		}
+		state[t] = visiting
+		path = append(path, t)
+		for _, d := range g.deps[t] {
+			if _, ok := g.deps[d]; !ok {
+				return &MissingDependencyError{Target: t, Dependency: d}
+			}
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[t] = done
+		order = append(order, t)
+		return nil
+	}
+
+	for _, t := range targets {
+		if _, ok := g.deps[t]; !ok {
+			return nil, fmt.Errorf("unknown target %s", t)
+		}
+		if err := visit(t); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,258 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/staffano/tcb/container"
+	"github.com/staffano/tcb/git"
+	"github.com/staffano/tcb/utils"
+	"github.com/staffano/tcb/workspace"
+)
+
+// Layer is a BitBake layer used by the builds. meta-crosstools is always
+// the first layer, further layers are given by the "layers" config key.
+type Layer struct {
+	// Name is the directory name of the layer in the workspace and in
+	// the container. It defaults to the last element of URL or Path.
+	Name string `mapstructure:"name"`
+	// URL and Rev are the git repository and revision to clone
+	URL string `mapstructure:"url"`
+	Rev string `mapstructure:"rev"`
+	// Path is a local layer, used in place. Relative paths are relative
+	// to the workspace.
+	Path string `mapstructure:"path"`
+}
+
+var layerNameRe = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// Dir returns the directory of the layer on the host
+func (l *Layer) Dir() string {
+	switch {
+	case l.Path != "":
+		return l.Path
+	case l.Name == metaCrosstools:
+		return workspace.Path(metaCrosstools)
+	}
+	return workspace.Path("layers", l.Name)
+}
+
+// MountPoint returns the directory of the layer in the container
+func (l *Layer) MountPoint() string {
+	if l.Name == metaCrosstools {
+		return "/" + metaCrosstools
+	}
+	return "/layers/" + l.Name
+}
+
+// Layers returns the layers of the builds, meta-crosstools first
+func Layers() ([]Layer, error) {
+	var configured []Layer
+	if err := viper.UnmarshalKey("layers", &configured); err != nil {
+		return nil, fmt.Errorf("reading the layers config: %w", err)
+	}
+
+	builder := Layer{
+		Name: metaCrosstools,
+		URL:  viper.GetString("builder.repo.url"),
+		Rev:  viper.GetString("builder.repo.rev"),
+	}
+	// A local checkout of the builder is used in place
+	if p := viper.GetString("builder.path"); p != "" {
+		builder.URL, builder.Rev, builder.Path = "", "", p
+	} else if u, err := url.Parse(builder.URL); err == nil && u.Scheme == "file" {
+		builder.URL, builder.Rev, builder.Path = "", "", u.Path
+	}
+	if builder.Path != "" && !filepath.IsAbs(builder.Path) {
+		builder.Path = workspace.Path(builder.Path)
+	}
+	layers := []Layer{builder}
+	seen := map[string]bool{metaCrosstools: true}
+	for i, l := range configured {
+		if (l.URL == "") == (l.Path == "") {
+			return nil, fmt.Errorf("layer %d: either url or path must be given", i+1)
+		}
+		if l.Name == "" {
+			l.Name = strings.TrimSuffix(path.Base(filepath.ToSlash(l.URL+l.Path)), ".git")
+		}
+		if !layerNameRe.MatchString(l.Name) || seen[l.Name] {
+			return nil, fmt.Errorf("layer %d: invalid or duplicate name %q", i+1, l.Name)
+		}
+		seen[l.Name] = true
+		if l.URL != "" && l.Rev == "" {
+			l.Rev = "master"
+		}
+		if l.Path != "" && !filepath.IsAbs(l.Path) {
+			l.Path = workspace.Path(l.Path)
+		}
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
+
+// layerDirs returns the directories of the layers, in the order conf
+// files are looked up: the last layer first, so it can override the
+// toolchain confs and include files of the layers before it.
+func layerDirs() ([]string, error) {
+	layers, err := Layers()
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for i := len(layers) - 1; i >= 0; i-- {
+		dirs = append(dirs, layers[i].Dir())
+	}
+	return dirs, nil
+}
+
+// CheckoutLayers clones the git layers that are missing and updates the
+// ones already cloned. Local layers are used as they are.
+func CheckoutLayers() error {
+	layers, err := Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		if l.Path != "" {
+			if !utils.PathExists(l.Path) {
+				return fmt.Errorf("layer %s: %s does not exist", l.Name, l.Path)
+			}
+			fmt.Printf("%s: using %s in place\n", l.Name, l.Path)
+			continue
+		}
+		if err = checkout(l.URL, l.Rev, l.Dir()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkout clones url into dir, or updates dir if it already exists, and
+// checks out rev
+func checkout(url, rev, dir string) error {
+	var (
+		commit string
+		err    error
+	)
+	exists := utils.PathExists(dir)
+	log.Printf("%s exists: %t", dir, exists)
+	if container.Offline() {
+		commit, err = checkoutOffline(url, rev, dir)
+	} else if !exists {
+		commit, err = git.Clone(url, dir, rev)
+	} else {
+		commit, err = git.Update(dir, rev)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s at %s\n", filepath.Base(dir), rev, commit)
+	return nil
+}
+
+// LayerRevision returns the revision of layer as a stamp input. Local
+// layers may be edited in place, so uncommitted changes are part of their
+// revision, and those that are not git repositories are identified by a
+// hash of their files.
+func LayerRevision(l *Layer) (string, error) {
+	rev, err := git.Head(l.Dir())
+	if err != nil && l.Path != "" {
+		sum, err := utils.HashDir(l.Path)
+		if err != nil {
+			return "", fmt.Errorf("hashing layer %s: %w", l.Name, err)
+		}
+		return "files:" + sum, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolving the %s revision: %w", l.Name, err)
+	}
+	if l.Path == "" {
+		return rev, nil
+	}
+	diff, err := git.DiffHash(l.Dir())
+	if err != nil {
+		return "", fmt.Errorf("reading the changes of layer %s: %w", l.Name, err)
+	}
+	if diff != "" {
+		rev += "+dirty:" + diff
+	}
+	return rev, nil
+}
+
+// LayerMounts returns the mounts of the layers in the build containers
+func LayerMounts() ([]container.Mount, error) {
+	layers, err := Layers()
+	if err != nil {
+		return nil, err
+	}
+	var mounts []container.Mount
+	for _, l := range layers {
+		mounts = append(mounts, container.Mount{Source: l.Dir(), Target: l.MountPoint()})
+	}
+	return mounts, nil
+}
+
+// Dockerfile renders the Dockerfile of the builder image, customized by
+// files in the builder layer and in the workspace, in that order. It also
+// returns the files used.
+func Dockerfile() (string, []string, error) {
+	layers, err := Layers()
+	if err != nil {
+		return "", nil, err
+	}
+	return container.RenderDockerfile(layers[0].Dir(), workspace.Path())
+}
+
+// ImageTag returns the tag of the builder image for the current Dockerfile
+// and bitbake.rev
+func ImageTag() (string, error) {
+	dockerfile, _, err := Dockerfile()
+	if err != nil {
+		return "", err
+	}
+	return container.ImageTag(dockerfile)
+}
+
+// BBLayersPath returns the bblayers.conf used when building target
+func BBLayersPath(target string) string {
+	return workspace.Path("build", target, "conf", "bblayers.conf")
+}
+
+// bblayersConf returns a bblayers.conf listing the layers as mounted in
+// the container
+func bblayersConf(layers []Layer) string {
+	var b strings.Builder
+	b.WriteString("# Generated by tcb\nBBPATH = \"${TOPDIR}\"\nBBFILES ?= \"\"\nBBLAYERS ?= \" \\\n")
+	for _, l := range layers {
+		fmt.Fprintf(&b, "  %s \\\n", l.MountPoint())
+	}
+	b.WriteString("  \"\n")
+	return b.String()
+}
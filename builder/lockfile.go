@@ -0,0 +1,208 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+
+	"github.com/staffano/tcb/container"
+	"github.com/staffano/tcb/git"
+	"github.com/staffano/tcb/workspace"
+)
+
+func init() {
+	viper.SetDefault("lockfile", "tcb.lock")
+}
+
+// LockFile pins the inputs of the builds, so a toolchain can be built
+// again from the same sources later. It is unrelated to the lock that
+// keeps tcb invocations from using the workspace at the same time.
+type LockFile struct {
+	Layers []LockedLayer `json:"layers"`
+	// Image is the id of the builder image
+	Image string `json:"image"`
+	// Bitbake is the commit of bitbake in the builder image
+	Bitbake string `json:"bitbake"`
+}
+
+// LockedLayer is the commit a layer is locked to
+type LockedLayer struct {
+	Name   string `json:"name"`
+	URL    string `json:"url,omitempty"`
+	Commit string `json:"commit"`
+}
+
+// LockError is returned when the inputs of a --locked build differ from
+// the lock file
+type LockError struct {
+	What   string
+	Locked string
+	Actual string
+}
+
+func (e *LockError) Error() string {
+	if e.Locked == "" {
+		return fmt.Sprintf("%s is not in %s, run tcb lock to add it", e.What, LockFilePath())
+	}
+	return fmt.Sprintf("%s is %s, but %s locks it to %s", e.What, e.Actual, LockFilePath(), e.Locked)
+}
+
+// LockFilePath returns the path of the lock file, given by the "lockfile"
+// config key. A relative path is relative to the workspace.
+func LockFilePath() string {
+	p := viper.GetString("lockfile")
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return workspace.Path(p)
+}
+
+// ReadLockFile reads the lock file
+func ReadLockFile() (*LockFile, error) {
+	content, err := ioutil.ReadFile(LockFilePath())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s does not exist, run tcb lock to create it", LockFilePath())
+	} else if err != nil {
+		return nil, err
+	}
+	lf := &LockFile{}
+	if err = json.Unmarshal(content, lf); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", LockFilePath(), err)
+	}
+	return lf, nil
+}
+
+// Write writes the lock file
+func (lf *LockFile) Write() error {
+	content, err := json.MarshalIndent(lf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(LockFilePath(), append(content, '\n'), 0644)
+}
+
+// NewLockFile records the layers as checked out and the builder image,
+// which must have been built
+func NewLockFile() (*LockFile, error) {
+	layers, err := Layers()
+	if err != nil {
+		return nil, err
+	}
+	lf := &LockFile{}
+	for i, l := range layers {
+		rev, err := LayerRevision(&layers[i])
+		if err != nil {
+			return nil, err
+		}
+		lf.Layers = append(lf.Layers, LockedLayer{Name: l.Name, URL: git.Redact(l.URL), Commit: rev})
+	}
+	tag, err := ImageTag()
+	if err != nil {
+		return nil, err
+	}
+	if lf.Image, err = container.ImageID(tag); err != nil {
+		return nil, fmt.Errorf("inspecting the builder image: %w", err)
+	}
+	if lf.Bitbake, err = container.BitbakeRevision(tag); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *LockFile) layer(name string) *LockedLayer {
+	for i := range lf.Layers {
+		if lf.Layers[i].Name == name {
+			return &lf.Layers[i]
+		}
+	}
+	return nil
+}
+
+// CheckoutLocked checks out the git layers at the commits of the lock
+// file, cloning the ones that are missing. Local layers are left alone.
+func (lf *LockFile) CheckoutLocked() error {
+	layers, err := Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		locked := lf.layer(l.Name)
+		if l.Path != "" || locked == nil {
+			continue
+		}
+		if err = checkout(l.URL, locked.Commit, l.Dir()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckLayers returns a LockError if a layer is not at its locked commit
+func (lf *LockFile) CheckLayers() error {
+	layers, err := Layers()
+	if err != nil {
+		return err
+	}
+	for i, l := range layers {
+		locked := lf.layer(l.Name)
+		if locked == nil {
+			return &LockError{What: "layer " + l.Name}
+		}
+		rev, err := LayerRevision(&layers[i])
+		if err != nil {
+			return err
+		}
+		if rev != locked.Commit {
+			return &LockError{What: "layer " + l.Name, Locked: locked.Commit, Actual: rev}
+		}
+	}
+	return nil
+}
+
+// CheckImage returns a LockError if the builder image is not the locked
+// one. The image must have been built.
+func (lf *LockFile) CheckImage() error {
+	tag, err := ImageTag()
+	if err != nil {
+		return err
+	}
+	id, err := container.ImageID(tag)
+	if err != nil {
+		return fmt.Errorf("inspecting the builder image: %w", err)
+	}
+	if id != lf.Image {
+		return &LockError{What: "the builder image", Locked: lf.Image, Actual: id}
+	}
+	rev, err := container.BitbakeRevision(tag)
+	if err != nil {
+		return err
+	}
+	if rev != lf.Bitbake {
+		return &LockError{What: "bitbake", Locked: lf.Bitbake, Actual: rev}
+	}
+	return nil
+}
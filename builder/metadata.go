@@ -0,0 +1,124 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"github.com/staffano/tcb/workspace"
+)
+
+// Toolchain describes a target as configured by its conf file
+type Toolchain struct {
+	Name         string   `json:"name"`
+	Build        string   `json:"build"`
+	Host         string   `json:"host"`
+	Target       string   `json:"target"`
+	GCC          string   `json:"gcc"`
+	Libc         string   `json:"libc"`
+	Kernel       string   `json:"kernel"`
+	Dependencies []string `json:"dependencies"`
+	// Built and Installed tell the state of the stamps, see Status
+	Built     string `json:"built"`
+	Installed string `json:"installed"`
+	// Bitbake is the commit of the bitbake the target was last built
+	// with, if it is known
+	Bitbake string `json:"bitbake,omitempty"`
+}
+
+// The stamp states reported in Toolchain
+const (
+	StatusDone  = "yes"
+	StatusStale = "stale"
+	StatusNone  = "no"
+)
+
+// The variables the metadata is read from. When there are several
+// candidates, the first one set in the conf is used.
+var (
+	buildVars  = []string{"BUILD_SYS"}
+	hostVars   = []string{"HOST_SYS"}
+	targetVars = []string{"TARGET_SYS"}
+	gccVars    = []string{"GCCVERSION"}
+	libcVars   = []string{"GLIBCVERSION", "LIBCVERSION", "MINGWVERSION", "NEWLIBVERSION", "MUSLVERSION"}
+	kernelVars = []string{"LINUXVERSION", "LINUXLIBCVERSION", "KERNELVERSION"}
+)
+
+func firstOf(conf *Conf, names []string) string {
+	for _, n := range names {
+		if conf.IsSet(n) {
+			return conf.Get(n)
+		}
+	}
+	return ""
+}
+
+// GetToolchain reads the metadata of target from its conf file, together
+// with the state of its stamps
+func GetToolchain(target string) (*Toolchain, error) {
+	conf, err := LoadConf(target)
+	if err != nil {
+		return nil, err
+	}
+	deps, err := GetDependencies(target)
+	if err != nil {
+		return nil, err
+	}
+	// Always a JSON array, also when there are none
+	if deps == nil {
+		deps = []string{}
+	}
+	tc := &Toolchain{
+		Name:         target,
+		Build:        firstOf(conf, buildVars),
+		Host:         firstOf(conf, hostVars),
+		Target:       firstOf(conf, targetVars),
+		GCC:          firstOf(conf, gccVars),
+		Libc:         firstOf(conf, libcVars),
+		Kernel:       firstOf(conf, kernelVars),
+		Dependencies: deps,
+		Built:        StatusNone,
+		Installed:    StatusNone,
+	}
+	if inputs, err := BuildInputs(target); err == nil {
+		tc.Built = stampStatus(BuildStamp(target), inputs)
+	} else if workspace.PathExists("stamps", BuildStamp(target)) {
+		// A dependency is no longer built
+		tc.Built = StatusStale
+	}
+	if inputs, err := InstallInputs(target); err == nil && tc.Built == StatusDone {
+		tc.Installed = stampStatus(InstallStamp(target), inputs)
+	} else if workspace.PathExists("stamps", InstallStamp(target)) {
+		tc.Installed = StatusStale
+	}
+	if stamp := workspace.ReadStamp(BuildStamp(target)); stamp != nil {
+		tc.Bitbake = stamp.Info["bitbake"]
+	}
+	return tc, nil
+}
+
+func stampStatus(stamp string, inputs map[string]string) string {
+	switch workspace.GetStamp(stamp, inputs) {
+	case workspace.StampValid:
+		return StatusDone
+	case workspace.StampStale:
+		return StatusStale
+	}
+	return StatusNone
+}
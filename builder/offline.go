@@ -0,0 +1,73 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+
+	"github.com/staffano/tcb/container"
+	"github.com/staffano/tcb/git"
+	"github.com/staffano/tcb/utils"
+)
+
+// offlineConf is appended last to local.conf by --offline builds, so no
+// fragment or override can turn the network back on
+const offlineConf = "# tcb --offline\nBB_NO_NETWORK = \"1\"\n"
+
+// MissingLayers returns the git layers an --offline build can't check
+// out, as "repo <url> at <rev>". They are not cloned, or don't have the
+// revision to check out, which is the commit of lf unless lf is nil. With
+// --keep-sources, only the clones have to exist.
+func MissingLayers(lf *LockFile) ([]string, error) {
+	layers, err := Layers()
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, l := range layers {
+		if l.Path != "" {
+			continue
+		}
+		rev := l.Rev
+		if lf != nil {
+			if locked := lf.layer(l.Name); locked != nil {
+				rev = locked.Commit
+			}
+		}
+		repo := fmt.Sprintf("repo %s at %s", git.Redact(l.URL), rev)
+		if !utils.PathExists(l.Dir()) {
+			missing = append(missing, repo)
+		} else if !viper.GetBool("keep-sources") && !git.HasRevision(l.Dir(), rev) {
+			missing = append(missing, repo)
+		}
+	}
+	return missing, nil
+}
+
+// checkoutOffline checks out rev in dir without fetching
+func checkoutOffline(url, rev, dir string) (string, error) {
+	if !utils.PathExists(dir) {
+		return "", &container.OfflineError{Missing: []string{fmt.Sprintf("repo %s at %s", git.Redact(url), rev)}}
+	}
+	return git.Checkout(dir, rev)
+}
@@ -0,0 +1,87 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Override is a variable set or appended to from the command line, given
+// by the "set" and "append" config keys as VAR=value strings.
+type Override struct {
+	Name   string
+	Value  string
+	Append bool
+}
+
+var overrideNameRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_\-:.+/~]*$`)
+
+// Overrides returns the configured overrides, the sets before the appends
+func Overrides() ([]Override, error) {
+	var res []Override
+	for _, key := range []string{"set", "append"} {
+		for _, s := range viper.GetStringSlice(key) {
+			kv := strings.SplitN(s, "=", 2)
+			if len(kv) != 2 || !overrideNameRe.MatchString(kv[0]) {
+				return nil, fmt.Errorf("invalid --%s %q, expected VAR=value", key, s)
+			}
+			res = append(res, Override{Name: kv[0], Value: kv[1], Append: key == "append"})
+		}
+	}
+	return res, nil
+}
+
+// overrideConf returns the local.conf lines of the overrides
+func overrideConf(overrides []Override) string {
+	if len(overrides) == 0 {
+		return ""
+	}
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	lines := []string{"", "# Overrides from the command line"}
+	for _, o := range overrides {
+		if o.Append {
+			// The _append spelling, as the pinned bitbake predates :append
+			lines = append(lines, fmt.Sprintf(`%s_append = " %s"`, o.Name, quote.Replace(o.Value)))
+		} else {
+			lines = append(lines, fmt.Sprintf(`%s = "%s"`, o.Name, quote.Replace(o.Value)))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// overrideInputs returns the overrides as stamp inputs, so a build with
+// overrides never shares its stamp with a build without them
+func overrideInputs(overrides []Override) map[string]string {
+	inputs := map[string]string{}
+	for _, o := range overrides {
+		if o.Append {
+			key := "append:" + o.Name
+			inputs[key] = joinNonEmpty(inputs[key], o.Value, " ")
+		} else {
+			inputs["set:"+o.Name] = o.Value
+		}
+	}
+	return inputs
+}
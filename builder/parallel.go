@@ -0,0 +1,99 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/spf13/viper"
+
+	"github.com/staffano/tcb/container"
+	"github.com/staffano/tcb/utils"
+)
+
+func init() {
+	viper.SetDefault("parallel.threads", 0)
+	viper.SetDefault("parallel.make-jobs", 0)
+	viper.SetDefault("parallel.job-memory", "2g")
+}
+
+// Parallelism returns the BB_NUMBER_THREADS and make -j of each build. They
+// are the CPUs available to a build, but no more than its memory allows
+// with parallel.job-memory per job. The CPUs and memory of the host are
+// shared by the --jobs builds running at the same time, and each build is
+// further confined by the limits of its container. The parallel.threads
+// and parallel.make-jobs config keys override the computed values.
+func Parallelism() (threads, makeJobs int, err error) {
+	limitCPUs, limitMem, err := container.Limits()
+	if err != nil {
+		return 0, 0, err
+	}
+	jobMem, err := utils.ParseSize(viper.GetString("parallel.job-memory"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid parallel.job-memory: %w", err)
+	}
+	jobs := viper.GetInt("jobs")
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	cpus := float64(runtime.NumCPU()) / float64(jobs)
+	if limitCPUs > 0 && limitCPUs < cpus {
+		cpus = limitCPUs
+	}
+	// Unknown when 0
+	mem := utils.MemAvailable() / int64(jobs)
+	if limitMem > 0 && (mem == 0 || limitMem < mem) {
+		mem = limitMem
+	}
+
+	n := int(cpus)
+	if mem > 0 && jobMem > 0 && int(mem/jobMem) < n {
+		n = int(mem / jobMem)
+	}
+	if n < 1 {
+		n = 1
+	}
+	threads, makeJobs = n, n
+	if t := viper.GetInt("parallel.threads"); t > 0 {
+		threads = t
+	}
+	if m := viper.GetInt("parallel.make-jobs"); m > 0 {
+		makeJobs = m
+	}
+	return threads, makeJobs, nil
+}
+
+// parallelismConf sets how many tasks and make jobs bitbake runs. Unlike
+// the fragments it doesn't affect the result of a build, so it is left out
+// of the stamp and changing --jobs doesn't make targets stale.
+func parallelismConf() (string, error) {
+	threads, makeJobs, err := Parallelism()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`
+BB_NUMBER_THREADS = "%d"
+
+MAKE_JX := "-j%d"
+`, threads, makeJobs), nil
+}
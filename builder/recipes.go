@@ -25,12 +25,13 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"regexp"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/spf13/viper"
 
-	"github.com/staffano/tcb/git"
+	"github.com/staffano/tcb/container"
 	"github.com/staffano/tcb/utils"
 	"github.com/staffano/tcb/workspace"
 )
@@ -38,81 +39,158 @@ import (
 func init() {
 	viper.SetDefault("builder.repo.url", "https://github.com/staffano/meta-crosstools.git")
 	viper.SetDefault("builder.repo.rev", "master")
+	viper.SetDefault("jobs", 1)
 }
 
 const metaCrosstools = "meta-crosstools"
 
-// CheckoutMetaCrosstools installs the meta-crosstools repository from
-// github.com/staffano/meta-crosstools
-func CheckoutMetaCrosstools() {
-
-	// Check if the directory exists
-	metaCrosstoolsDir := workspace.Path(metaCrosstools)
-	ctExists := workspace.PathExists(metaCrosstools)
-	log.Printf("%s exists: %t", metaCrosstoolsDir, ctExists)
-	if ctExists {
-		workspace.Push(metaCrosstools)
-		git.Pull()
-		workspace.Pop()
-	} else {
-		git.Clone(viper.GetString("builder.repo.url"), metaCrosstoolsDir, viper.GetString("builder.repo.rev"))
+// GetAllTargets retrieves all targets defined in conf/toolchains of the
+// layers
+func GetAllTargets() ([]string, error) {
+	layers, err := Layers()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var result []string
+	for _, l := range layers {
+		confDir := filepath.Join(l.Dir(), "conf", "toolchains")
+		files, err := ioutil.ReadDir(confDir)
+		if os.IsNotExist(err) && l.Name != metaCrosstools {
+			// Not every layer has toolchains
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("listing toolchain targets: %w", err)
+		}
+		for _, file := range files {
+			t := strings.TrimSuffix(file.Name(), ".conf")
+			if strings.HasSuffix(file.Name(), ".conf") && !seen[t] {
+				seen[t] = true
+				result = append(result, t)
+			}
+		}
 	}
+	sort.Strings(result)
+	return result, nil
 }
 
-// GetAllTargets retrieves all targets defined inside meta-crosstools/conf/toolchain
-func GetAllTargets() []string {
-	var result []string
-	confDir := workspace.Path("meta-crosstools", "conf", "toolchains")
-	files, err := ioutil.ReadDir(confDir)
+// ConfPath returns the path of the toolchain conf of target. When several
+// layers have a conf for target, the one in the last layer is used.
+func ConfPath(target string) (string, error) {
+	dirs, err := layerDirs()
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range dirs {
+		p := filepath.Join(dir, "conf", "toolchains", target+".conf")
+		if utils.PathExists(p) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("no layer has a toolchain conf for %s", target)
+}
+
+// LoadConf parses the toolchain conf of target. Included and required
+// files are resolved relative to the layers, the last layer first.
+func LoadConf(target string) (*Conf, error) {
+	src, err := ConfPath(target)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := layerDirs()
+	if err != nil {
+		return nil, err
+	}
+	conf, err := ParseConf(src, dirs)
+	if err != nil {
+		return nil, fmt.Errorf("reading the conf of %s: %w", target, err)
+	}
+	return conf, nil
+}
+
+// GetDependencies returns a list of other targets this target depends on.
+// They are given by a "# /// DEPENDENCIES=a,b" comment in the conf.
+func GetDependencies(target string) ([]string, error) {
+	conf, err := LoadConf(target)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".conf") {
-			result = append(result, strings.TrimSuffix(file.Name(), ".conf"))
+	var deps []string
+	for _, d := range strings.Split(conf.Annotations["DEPENDENCIES"], ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			deps = append(deps, d)
 		}
 	}
-	return result
+	return deps, nil
 }
 
-// GetDependencies returns a list of other targets this target depends on
-func GetDependencies(target string) []string {
-	src := workspace.Path("meta-crosstools", "conf", "toolchains", target+".conf")
-	content, _ := ioutil.ReadFile(src)
-	re := regexp.MustCompile(`^#\s* ///\s*DEPENDENCIES=(\S*)+`)
-	matches := re.FindSubmatch(content)
-	if matches == nil {
-		return nil
-	}
-	fmt.Println(matches[1])
-	return strings.Split(string(matches[1][:]), ",")
+// BuildDir returns the build directory of target. Each target has its own,
+// so targets can be built concurrently and inspected or cleaned one by one.
+func BuildDir(target string) string {
+	return workspace.Path("build", target)
 }
 
-// SetTarget initializes the local.conf for the target
-func SetTarget(target string) {
+// LocalConfPath returns the local.conf used when building target
+func LocalConfPath(target string) string {
+	return workspace.Path("build", target, "conf", "local.conf")
+}
+
+// SetTarget initializes the local.conf in the build directory of target
+func SetTarget(target string) error {
 	// Now, lets build this specific target
-	workspace.MakeDir(0777, "build", "conf")
+	if err := workspace.MakeDir(0777, "build", target, "conf"); err != nil {
+		return err
+	}
+
+	// The layers as mounted in the container
+	layers, err := Layers()
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(BBLayersPath(target), []byte(bblayersConf(layers)), 0644); err != nil {
+		return err
+	}
 
-	// Create a copy of $wsp/meta-crosstools/conf/toolchains/<target>.conf to
-	// $wsp/build/conf/local.conf
-	src := workspace.Path("meta-crosstools", "conf", "toolchains", target+".conf")
-	dst := workspace.Path("build", "conf", "local.conf")
+	// Create a copy of <layer>/conf/toolchains/<target>.conf to
+	// $wsp/build/<target>/conf/local.conf
+	src, err := ConfPath(target)
+	if err != nil {
+		return err
+	}
+	dst := LocalConfPath(target)
 	os.RemoveAll(dst)
-	utils.CopyFile(src, dst)
+	if err := utils.CopyFile(src, dst); err != nil {
+		return fmt.Errorf("creating local.conf for %s: %w", target, err)
+	}
 	log.Printf("Copied %s to %s", src, dst)
 
-	// Append some specifics to local.conf
-	f, err := os.OpenFile(dst, os.O_APPEND|os.O_WRONLY, 0600)
+	overrides, err := Overrides()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer f.Close()
-	if _, err = f.WriteString(`
-BB_NUMBER_THREADS = "12"
-		
-MAKE_JX := "-j12"
-	`); err != nil {
-		panic(err)
+	parallelism, err := parallelismConf()
+	if err != nil {
+		return err
+	}
+	fragments, err := Fragments(target)
+	if err != nil {
+		return err
 	}
 
+	// Append some specifics to local.conf, in the order documented by
+	// Fragments, with the overrides last so they win, except for the
+	// BB_NO_NETWORK of --offline
+	f, err := os.OpenFile(dst, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	conf := parallelism + fragmentConf(fragments) + overrideConf(overrides)
+	if container.Offline() {
+		conf += offlineConf
+	}
+	if _, err = f.WriteString(conf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
@@ -0,0 +1,92 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"fmt"
+	"log"
+)
+
+// Schedule runs build for each target in order, running at most jobs of
+// them at the same time. A target is not started until all its dependencies
+// have been built. When a build fails no new builds are started, and the
+// error of the first failing build is returned once the running builds
+// have finished.
+func (g *Graph) Schedule(order []string, jobs int, build func(target string) error) error {
+	type result struct {
+		target string
+		err    error
+	}
+	var (
+		pending  = append([]string{}, order...)
+		finished = map[string]bool{}
+		running  int
+		firstErr error
+		results  = make(chan result)
+	)
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	ready := func(t string) bool {
+		for _, d := range g.deps[t] {
+			if !finished[d] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		// Start the targets that are ready, in build order
+		for i := 0; firstErr == nil && i < len(pending) && running < jobs; {
+			t := pending[i]
+			if !ready(t) {
+				i++
+				continue
+			}
+			pending = append(pending[:i], pending[i+1:]...)
+			running++
+			log.Printf("Starting %s, %d of %d jobs running", t, running, jobs)
+			go func() {
+				results <- result{target: t, err: build(t)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+
+		r := <-results
+		running--
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		finished[r.target] = true
+	}
+
+	if firstErr == nil && len(pending) > 0 {
+		return fmt.Errorf("could not schedule %v, their dependencies are not part of the build", pending)
+	}
+	return firstErr
+}
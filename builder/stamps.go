@@ -0,0 +1,127 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package builder
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/staffano/tcb/utils"
+	"github.com/staffano/tcb/workspace"
+)
+
+// BuildStamp is the name of the stamp set when target has been built
+func BuildStamp(target string) string {
+	return target + ".build"
+}
+
+// InstallStamp is the name of the stamp set when target has been installed
+func InstallStamp(target string) string {
+	return target + ".install"
+}
+
+// BuildInputs returns everything the build of target depends on, as input
+// name mapped to a hash or revision. The dependencies of target must have
+// been built before calling this, as their stamps are part of the inputs.
+func BuildInputs(target string) (map[string]string, error) {
+	var err error
+	inputs := map[string]string{}
+
+	layers, err := Layers()
+	if err != nil {
+		return nil, err
+	}
+	conf, err := LoadConf(target)
+	if err != nil {
+		return nil, err
+	}
+	if inputs["conf"], err = utils.HashFile(conf.Files[0]); err != nil {
+		return nil, fmt.Errorf("hashing toolchain conf of %s: %w", target, err)
+	}
+	// Files included by the conf are inputs as well
+	for _, f := range conf.Files[1:] {
+		if inputs["include:"+layerRelative(layers, f)], err = utils.HashFile(f); err != nil {
+			return nil, fmt.Errorf("hashing %s: %w", f, err)
+		}
+	}
+	fragments, err := Fragments(target)
+	if err != nil {
+		return nil, err
+	}
+	inputs["local.conf"] = utils.HashString(fragmentConf(fragments))
+	overrides, err := Overrides()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range overrideInputs(overrides) {
+		inputs[k] = v
+	}
+	dockerfile, _, err := Dockerfile()
+	if err != nil {
+		return nil, err
+	}
+	inputs["dockerfile"] = utils.HashString(dockerfile)
+
+	for i, l := range layers {
+		key := "layer:" + l.Name
+		if i == 0 {
+			key = "builder"
+		}
+		if inputs[key], err = LayerRevision(&layers[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	deps, err := GetDependencies(target)
+	if err != nil {
+		return nil, err
+	}
+	for _, dep := range deps {
+		stamp := workspace.ReadStamp(BuildStamp(dep))
+		if stamp == nil {
+			return nil, fmt.Errorf("dependency %s of %s has not been built", dep, target)
+		}
+		inputs["dep:"+dep] = stamp.Digest
+	}
+	return inputs, nil
+}
+
+// layerRelative names file by its layer and its path in the layer
+func layerRelative(layers []Layer, file string) string {
+	for _, l := range layers {
+		if rel, err := filepath.Rel(l.Dir(), file); err == nil && !strings.HasPrefix(rel, "..") {
+			return path.Join(l.Name, filepath.ToSlash(rel))
+		}
+	}
+	return file
+}
+
+// InstallInputs returns what the installation of target depends on, which
+// is the build of the target.
+func InstallInputs(target string) (map[string]string, error) {
+	stamp := workspace.ReadStamp(BuildStamp(target))
+	if stamp == nil {
+		return nil, fmt.Errorf("%s has not been built", target)
+	}
+	return map[string]string{"build": stamp.Digest}, nil
+}
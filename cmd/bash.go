@@ -21,21 +21,43 @@
 package cmd
 
 import (
+	"fmt"
+
 	"github.com/spf13/cobra"
-	"github.com/staffano/tcb/docker"
-	"github.com/staffano/tcb/workspace"
+	"github.com/staffano/tcb/builder"
+	"github.com/staffano/tcb/container"
 )
 
 // bashCmd represents the bash command
 var bashCmd = &cobra.Command{
-	Use:   "bash",
-	Short: "start a bash shell in the build containers",
-	Run: func(cmd *cobra.Command, args []string) {
-		docker.RunBash(workspace.Path("results"), workspace.Path("meta-crosstools"),
-			workspace.Path("build", "conf", "local.conf"))
+	Use:   "bash <target>",
+	Short: "start a bash shell in the build container of a target",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fail(exitUsage, fmt.Errorf("bash needs the target to open a shell for"))
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkBuildFlags(); err != nil {
+			return err
+		}
+		if err := lockWorkspace(); err != nil {
+			return err
+		}
+		if err := builder.SetTarget(args[0]); err != nil {
+			return err
+		}
+		job, err := newJob(args[0])
+		if err != nil {
+			return err
+		}
+		return runFailure(container.RunBash(job))
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(bashCmd)
+	addOverrideFlags(bashCmd)
+	addResourceFlags(bashCmd)
 }
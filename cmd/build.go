@@ -21,12 +21,14 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"log"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/staffano/tcb/builder"
-	"github.com/staffano/tcb/docker"
+	"github.com/staffano/tcb/container"
 	"github.com/staffano/tcb/workspace"
 )
 
@@ -34,55 +36,288 @@ import (
 var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "Build toolchain(s)",
-	Run:   Build,
+	RunE:  Build,
 }
 
 func init() {
 	RootCmd.AddCommand(buildCmd)
+	addJobsFlag(buildCmd)
+	addOverrideFlags(buildCmd)
+	addResourceFlags(buildCmd)
+	addLockedFlag(buildCmd)
+}
+
+// addJobsFlag adds the --jobs flag to commands that build targets
+func addJobsFlag(cmd *cobra.Command) {
+	cmd.Flags().IntP("jobs", "j", 1, "Number of targets to build concurrently.")
+}
+
+// addOverrideFlags adds the flags overriding variables in local.conf
+func addOverrideFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray("set", nil, "Set a variable in local.conf, as VAR=value. May be repeated.")
+	cmd.Flags().StringArray("append", nil, "Append to a variable in local.conf, as VAR=value. May be repeated.")
+}
+
+// addResourceFlags adds the flags limiting the resources of the builds
+func addResourceFlags(cmd *cobra.Command) {
+	cmd.Flags().Float64("cpus", 0, "Number of CPUs each build container may use, 0 for no limit.")
+	cmd.Flags().String("memory", "", "Memory each build container may use, e.g. 8g. Empty for no limit.")
+	cmd.Flags().Int("threads", 0, "BB_NUMBER_THREADS of each build, 0 to derive it from the CPUs and memory.")
+	cmd.Flags().Int("make-jobs", 0, "make -j of each build, 0 to derive it from the CPUs and memory.")
+}
+
+// checkBuildFlags reports malformed overrides, layers and resource settings
+// as usage errors before anything is built
+func checkBuildFlags() error {
+	if _, err := builder.Overrides(); err != nil {
+		return fail(exitUsage, err)
+	}
+	if _, err := builder.Layers(); err != nil {
+		return fail(exitUsage, err)
+	}
+	threads, makeJobs, err := builder.Parallelism()
+	if err != nil {
+		return fail(exitUsage, err)
+	}
+	log.Printf("Each build runs %d bitbake threads and make -j%d", threads, makeJobs)
+	return nil
 }
 
 // Build builds the targets specified. If no target och "all" target is
 // specified then all known targets will be built.
 // If preconfigured is set, then the targets specified in the builder
 // will be built
-func Build(cmd *cobra.Command, targets []string) {
+func Build(cmd *cobra.Command, targets []string) error {
+	if err := checkBuildFlags(); err != nil {
+		return err
+	}
+	if err := lockWorkspace(); err != nil {
+		return err
+	}
 	log.Printf("builder.Build(%v)", targets)
+	if err := prepareSources(); err != nil {
+		return err
+	}
+
+	_, err := buildTargets(targets)
+	return err
+}
+
+// addLockedFlag adds the --locked flag to commands that build targets
+func addLockedFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("locked", false, "Build strictly from the layers and builder image recorded in tcb.lock.")
+}
+
+// prepareSources checks out the layers, unless --keep-sources is given.
+// With --locked they are checked out at the commits of the lock file, and
+// it is an error if they are not at those commits afterwards.
+func prepareSources() error {
+	if !viper.GetBool("locked") {
+		if err := checkOffline(nil); err != nil {
+			return err
+		}
+		if viper.GetBool("keep-sources") {
+			return nil
+		}
+		return builder.CheckoutLayers()
+	}
+	lf, err := builder.ReadLockFile()
+	if err != nil {
+		return fail(exitLocked, err)
+	}
+	if err = checkOffline(lf); err != nil {
+		return err
+	}
 	if !viper.GetBool("keep-sources") {
-		builder.CheckoutMetaCrosstools()
+		if err = lf.CheckoutLocked(); err != nil {
+			return err
+		}
+	}
+	return lf.CheckLayers()
+}
+
+// checkOffline lists the layers and the builder image that are missing for
+// an --offline build, all at once. lf is the lock file of a --locked build.
+func checkOffline(lf *builder.LockFile) error {
+	if !container.Offline() {
+		return nil
+	}
+	missing, err := builder.MissingLayers(lf)
+	if err != nil {
+		return err
+	}
+	var offErr *container.OfflineError
+	tag, err := builder.ImageTag()
+	if errors.As(err, &offErr) {
+		// There is no image for bitbake.rev to take the tag from
+		missing = append(missing, offErr.Missing...)
+	} else if err != nil {
+		return runFailure(err)
+	} else if ok, err := container.HasImage(tag); err != nil {
+		return runFailure(err)
+	} else if !ok {
+		missing = append(missing, "image "+tag)
+	}
+	if len(missing) > 0 {
+		return &container.OfflineError{Missing: missing}
+	}
+	return nil
+}
+
+// buildTargets builds the targets together with their dependencies, running
+// up to --jobs builds at the same time. It returns the build order.
+func buildTargets(targets []string) ([]string, error) {
+	g, err := builder.LoadGraph()
+	if err != nil {
+		return nil, err
+	}
+	order, err := g.Order(targets...)
+	if err != nil {
+		return nil, fail(exitUsage, err)
 	}
+	log.Printf("Build order: %v", order)
 
-	if len(targets) == 0 || targets[0] == "all" {
-		allTargets := builder.GetAllTargets()
-		for _, t := range allTargets {
-			BuildTarget(t)
+	// Make sure docker image is built
+	if err = buildImage(); err != nil {
+		return nil, err
+	}
+	if !viper.GetBool("dryrun") {
+		if err = checkBitbake(); err != nil {
+			return nil, err
 		}
-	} else {
-		BuildTarget(targets[0])
 	}
+	if viper.GetBool("locked") {
+		lf, err := builder.ReadLockFile()
+		if err != nil {
+			return nil, fail(exitLocked, err)
+		}
+		var lockErr *builder.LockError
+		if err = lf.CheckImage(); errors.As(err, &lockErr) {
+			return nil, err
+		} else if err != nil {
+			return nil, runFailure(err)
+		}
+	}
+
+	err = g.Schedule(order, viper.GetInt("jobs"), BuildTarget)
+	return order, err
 }
 
-// BuildTarget builds one target
-func BuildTarget(target string) {
-	stamp := target + ".build"
-	// Skip if already built
-	if workspace.GetStamp(stamp) {
-		return
+// buildImage builds the builder image
+func buildImage() error {
+	dockerfile, sources, err := builder.Dockerfile()
+	if err != nil {
+		return err
+	}
+	for _, s := range sources {
+		log.Printf("Builder image customized by %s", s)
 	}
+	_, err = container.BuildImage(dockerfile)
+	return runFailure(err)
+}
 
-	// Then we have to build any dependencies
-	deps := builder.GetDependencies(target)
-	for _, t := range deps {
-		BuildTarget(t)
+// checkBitbake makes sure the builder image has the bitbake of bitbake.rev
+func checkBitbake() error {
+	tag, err := builder.ImageTag()
+	if err != nil {
+		return err
+	}
+	commit, err := container.CheckBitbake(tag)
+	if err != nil {
+		return runFailure(err)
+	}
+	if commit != "" {
+		log.Printf("Using bitbake %s", commit)
 	}
+	return nil
+}
 
-	builder.SetTarget(target)
+// newJob returns the container job building target
+func newJob(target string) (*container.Job, error) {
+	layers, err := builder.LayerMounts()
+	if err != nil {
+		return nil, err
+	}
+	tag, err := builder.ImageTag()
+	if err != nil {
+		return nil, err
+	}
+	return &container.Job{
+		Target:        target,
+		Image:         tag,
+		ResultDir:     workspace.Path("results"),
+		Layers:        layers,
+		LocalConfPath: builder.LocalConfPath(target),
+		BBLayersPath:  builder.BBLayersPath(target),
+	}, nil
+}
 
-	// Make sure docker image is built
-	docker.BuildImage()
+// runFailure classifies an error returned by the container runtime. Errors
+// from the command run in the container and from the image build have their
+// own types, anything else means the runtime itself failed.
+func runFailure(err error) error {
+	var (
+		exitErr *container.ExitError
+		imgErr  *container.ImageError
+		bbErr   *container.BitbakeError
+		offErr  *container.OfflineError
+	)
+	if errors.As(err, &exitErr) || errors.As(err, &imgErr) || errors.As(err, &bbErr) || errors.As(err, &offErr) {
+		return err
+	}
+	return fail(exitRuntime, err)
+}
+
+// BuildTarget builds one target, unless it has already been built from the
+// same inputs. The dependencies of target must already have been built. A
+// failed build, or a --dryrun, leaves no stamp.
+func BuildTarget(target string) error {
+	stamp := builder.BuildStamp(target)
+
+	inputs, err := builder.BuildInputs(target)
+	if err != nil {
+		return err
+	}
+	// Skip if already built
+	if workspace.GetStamp(stamp, inputs) == workspace.StampValid {
+		return nil
+	}
+
+	if err = builder.SetTarget(target); err != nil {
+		return err
+	}
 
 	// Run bitbake dockerized
-	workspace.MakeDir(0777, "results")
-	docker.Execute(workspace.Path("results"), workspace.Path("meta-crosstools"),
-		workspace.Path("build", "conf", "local.conf"), "bitbake", "image")
-	workspace.SetStamp(stamp)
+	if err = workspace.MakeDir(0777, "results"); err != nil {
+		return err
+	}
+	job, err := newJob(target)
+	if err != nil {
+		return err
+	}
+	if container.Offline() {
+		// Fail before building anything if sources are missing
+		missing, err := container.MissingSources(job)
+		if err != nil {
+			return runFailure(fmt.Errorf("fetching the sources of %s: %w", target, err))
+		}
+		if len(missing) > 0 {
+			return &container.OfflineError{Missing: missing}
+		}
+	}
+	if _, err = container.Execute(job, "bitbake", "image"); err != nil {
+		return runFailure(fmt.Errorf("building %s: %w", target, err))
+	}
+	if viper.GetBool("dryrun") {
+		// Nothing was built
+		return nil
+	}
+	s := workspace.NewStamp(inputs)
+	s.Info = map[string]string{"runtime": viper.GetString("runtime"), "image": job.Image}
+	if commit, err := container.BitbakeRevision(job.Image); err == nil {
+		s.Info["bitbake"] = commit
+	} else {
+		log.Printf("Not recording the bitbake of %s: %v", target, err)
+	}
+	return workspace.SetStamp(stamp, s)
 }
@@ -0,0 +1,94 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/staffano/tcb/builder"
+	"github.com/staffano/tcb/workspace"
+)
+
+// testWorkspace sets up a workspace and a local builder layer with the
+// toolchain conf of target, for builds with the native runtime and a
+// bitbake that fails if it is run
+func testWorkspace(t *testing.T, target string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tcb-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	confs := filepath.Join(dir, "builder", "conf", "toolchains")
+	if err = os.MkdirAll(confs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	conf := "# /// DEPENDENCIES=\nTARGET_SYS = \"x86_64-pc-linux-gnu\"\n"
+	if err = ioutil.WriteFile(filepath.Join(confs, target+".conf"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The native runtime wants bitbake in PATH. It fails if it is run.
+	bin := filepath.Join(dir, "bin")
+	if err = os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(bin, "bitbake"), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	oldWd := workspace.Wd
+	workspace.Wd = filepath.Join(dir, "ws")
+	if err = os.Mkdir(workspace.Wd, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { workspace.Wd = oldWd })
+	for k, v := range map[string]interface{}{
+		"builder.path": filepath.Join(dir, "builder"),
+		"runtime":      "native",
+	} {
+		old := viper.Get(k)
+		viper.Set(k, v)
+		t.Cleanup(func() { viper.Set(k, old) })
+	}
+}
+
+func TestBuildTargetDryrun(t *testing.T) {
+	testWorkspace(t, "native")
+	viper.Set("dryrun", true)
+	defer viper.Set("dryrun", nil)
+
+	if err := BuildTarget("native"); err != nil {
+		t.Fatalf("BuildTarget: %v", err)
+	}
+	inputs, err := builder.BuildInputs("native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := workspace.GetStamp(builder.BuildStamp("native"), inputs); st == workspace.StampValid {
+		t.Error("a dryrun build left a valid stamp")
+	}
+}
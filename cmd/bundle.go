@@ -0,0 +1,107 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/staffano/tcb/builder"
+)
+
+// defaultBundle is the archive written by bundle export without arguments
+const defaultBundle = "tcb-bundle.tar"
+
+// bundleCmd groups the commands moving builds to hosts without network
+// access
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Move the builder image, downloads and layers to offline hosts",
+}
+
+// bundleExportCmd represents the bundle export command
+var bundleExportCmd = &cobra.Command{
+	Use:   "export [file]",
+	Short: "Write the builder image, downloads and layers to an archive",
+	Long: `Write the builder image, the contents of the bb-downloads volume and
+git bundles of the layers to a single archive, tcb-bundle.tar by default.
+Build the targets first, so the downloads volume holds all their sources.
+Local layers are not included.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file := defaultBundle
+		if len(args) > 0 {
+			file = args[0]
+		}
+		if err := lockWorkspace(); err != nil {
+			return err
+		}
+		if _, err := builder.Layers(); err != nil {
+			return fail(exitUsage, err)
+		}
+		b, err := builder.ExportBundle(invocationPath(file))
+		if err != nil {
+			return err
+		}
+		printBundle(b)
+		return nil
+	},
+}
+
+// bundleImportCmd represents the bundle import command
+var bundleImportCmd = &cobra.Command{
+	Use:   "import file",
+	Short: "Restore the builder image, downloads and layers of an archive",
+	Long: `Load the builder image of an archive written by tcb bundle export, add its
+downloads to the bb-downloads volume and check out the layers at the
+commits they were exported at. Build with --offline afterwards, so
+nothing is fetched again.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := lockWorkspace(); err != nil {
+			return err
+		}
+		if _, err := builder.Layers(); err != nil {
+			return fail(exitUsage, err)
+		}
+		b, err := builder.ImportBundle(invocationPath(args[0]))
+		if err != nil {
+			return err
+		}
+		printBundle(b)
+		return nil
+	},
+}
+
+func printBundle(b *builder.Bundle) {
+	for _, l := range b.Layers {
+		fmt.Printf("%-20s %s\n", l.Name, l.Commit)
+	}
+	if b.Image != "" {
+		fmt.Printf("%-20s %s\n", "builder image", b.Image)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(bundleCmd)
+	bundleCmd.AddCommand(bundleExportCmd)
+	bundleCmd.AddCommand(bundleImportCmd)
+}
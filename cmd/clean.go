@@ -21,20 +21,27 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strings"
 
 	"github.com/spf13/cobra"
-	"github.com/staffano/tcb/docker"
+	"github.com/staffano/tcb/builder"
+	"github.com/staffano/tcb/container"
 	"github.com/staffano/tcb/workspace"
 )
 
 // cleanCmd represents the clean command
 var cleanCmd = &cobra.Command{
-	Use:   "clean",
+	Use:   "clean [all|stamps|results|docker|<target>]...",
 	Short: "Really cleans everything...",
-	Run:   Clean,
+	Long: `Without arguments, or with "all", everything is cleaned: the containers,
+volumes and image of tcb, and the whole workspace.
+
+Given a target, only the build directory, tmp volume and stamps of that
+target are removed.`,
+	RunE: Clean,
 }
 
 func init() {
@@ -42,24 +49,65 @@ func init() {
 }
 
 // Clean results and intermediate files
-func Clean(cmd *cobra.Command, targets []string) {
+func Clean(cmd *cobra.Command, targets []string) error {
+	if err := lockWorkspace(); err != nil {
+		return err
+	}
 	log.Printf("builder.Clean(%v)", targets)
 	if len(targets) == 0 {
-		docker.Prune()
-		workspace.Reset()
-		return
+		targets = []string{"all"}
 	}
 	for _, t := range targets {
+		var err error
 		switch ut := strings.ToUpper(t); ut {
 		case "STAMPS":
-			os.RemoveAll(workspace.Path("stamps"))
+			err = removeAll(workspace.Path("stamps"))
 		case "RESULTS":
-			os.RemoveAll(workspace.Path("results"))
+			err = removeAll(workspace.Path("results"))
 		case "DOCKER":
-			docker.Prune()
+			err = prune()
 		case "ALL":
-			docker.Prune()
-			workspace.Reset()
+			if err = prune(); err == nil {
+				err = workspace.Reset()
+			}
+		default:
+			err = cleanTarget(t)
 		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune removes all containers, volumes and images created by tcb
+func prune() error {
+	if err := container.Prune(); err != nil {
+		return fail(exitRuntime, fmt.Errorf("pruning the container runtime: %w", err))
+	}
+	return nil
+}
+
+func removeAll(path string) error {
+	if err := os.RemoveAll(path); err != nil {
+		return &workspace.Error{Op: "remove", Path: path, Err: err}
+	}
+	return nil
+}
+
+// cleanTarget removes the build directory, tmp volume and stamps of target
+func cleanTarget(target string) error {
+	if !workspace.PathExists("build", target) && !workspace.PathExists("stamps", builder.BuildStamp(target)) {
+		return fail(exitUsage, fmt.Errorf("don't know how to clean %s, it is not a built target", target))
+	}
+	if err := container.RemoveTarget(target); err != nil {
+		return fail(exitRuntime, fmt.Errorf("removing the tmp volume of %s: %w", target, err))
+	}
+	if err := removeAll(builder.BuildDir(target)); err != nil {
+		return err
+	}
+	if err := workspace.RemoveStamp(builder.InstallStamp(target)); err != nil {
+		return err
 	}
+	return workspace.RemoveStamp(builder.BuildStamp(target))
 }
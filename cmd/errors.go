@@ -0,0 +1,124 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+
+	"github.com/staffano/tcb/builder"
+	"github.com/staffano/tcb/container"
+	"github.com/staffano/tcb/git"
+	"github.com/staffano/tcb/workspace"
+)
+
+// Exit codes of tcb, one for each class of failure
+const (
+	exitOK = iota
+	// exitFailure is used for errors not covered by the other classes
+	exitFailure
+	// exitUsage means the command line or configuration is wrong
+	exitUsage
+	// exitWorkspace means the workspace could not be read or written
+	exitWorkspace
+	// exitSource means fetching the builder repository failed
+	exitSource
+	// exitTargets means the toolchain confs are broken, e.g. a
+	// dependency cycle
+	exitTargets
+	// exitRuntime means the container runtime could not be used
+	exitRuntime
+	// exitImage means building the builder image failed, or its bitbake
+	// is not the one of bitbake.rev
+	exitImage
+	// exitBuild means bitbake failed
+	exitBuild
+	// exitBusy means another tcb is using the workspace
+	exitBusy
+	// exitLocked means the sources or the builder image don't match
+	// tcb.lock
+	exitLocked
+	// exitOffline means inputs of an --offline run are missing
+	exitOffline
+)
+
+// failure is an error that knows which exit code tcb should use
+type failure struct {
+	code int
+	err  error
+}
+
+func (f *failure) Error() string {
+	return f.err.Error()
+}
+
+func (f *failure) Unwrap() error {
+	return f.err
+}
+
+// fail tags err with an exit code, unless err is nil or already tagged
+func fail(code int, err error) error {
+	var f *failure
+	if err == nil || errors.As(err, &f) {
+		return err
+	}
+	return &failure{code: code, err: err}
+}
+
+// exitCode returns the exit code for err. Errors that have not been tagged
+// with fail are classified by their type.
+func exitCode(err error) int {
+	var (
+		f        *failure
+		wsErr    *workspace.Error
+		gitErr   *git.Error
+		cycleErr *builder.CycleError
+		depErr   *builder.MissingDependencyError
+		imgErr   *container.ImageError
+		bbErr    *container.BitbakeError
+		exitErr  *container.ExitError
+		busyErr  *workspace.BusyError
+		lockErr  *builder.LockError
+		offErr   *container.OfflineError
+	)
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &f):
+		return f.code
+	case errors.As(err, &exitErr):
+		return exitBuild
+	case errors.As(err, &imgErr), errors.As(err, &bbErr):
+		return exitImage
+	case errors.As(err, &gitErr):
+		return exitSource
+	case errors.As(err, &cycleErr), errors.As(err, &depErr):
+		return exitTargets
+	case errors.As(err, &busyErr):
+		return exitBusy
+	case errors.As(err, &lockErr):
+		return exitLocked
+	case errors.As(err, &offErr):
+		return exitOffline
+	case errors.As(err, &wsErr):
+		return exitWorkspace
+	}
+	return exitFailure
+}
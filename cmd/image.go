@@ -0,0 +1,152 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/staffano/tcb/builder"
+	"github.com/staffano/tcb/container"
+	"github.com/staffano/tcb/docker"
+	"github.com/staffano/tcb/utils"
+)
+
+// imageCmd groups the commands about the builder image
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Inspect and clean up the builder images",
+}
+
+// imageShowCmd represents the image show command
+var imageShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the effective Dockerfile of the builder image",
+	Long: `Print the Dockerfile the builder image is built from, rendered with the
+image.base and image.packages config keys, and with the image/Dockerfile
+and image/Dockerfile.extend files of the builder layer and the workspace
+applied. The files used are listed on stderr.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dockerfile, sources, err := builder.Dockerfile()
+		if err != nil {
+			return err
+		}
+		for _, s := range sources {
+			fmt.Fprintf(os.Stderr, "# using %s\n", s)
+		}
+		fmt.Print(dockerfile)
+		return nil
+	},
+}
+
+// imageLsCmd represents the image ls command
+var imageLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the builder images",
+	Long: `List the builder images, the newest first. The image of the current
+Dockerfile is marked current, and the one in tcb.lock locked.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		images, err := container.Images()
+		if err != nil {
+			return runFailure(err)
+		}
+		current, locked, err := imagesInUse()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TAG\tID\tCREATED\tSIZE\tIN USE")
+		for _, img := range images {
+			var use []string
+			if img.Tag == current {
+				use = append(use, "current")
+			}
+			if img.ID == locked {
+				use = append(use, "locked")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", img.Tag, docker.ShortID(img.ID),
+				img.Created.Format(time.RFC3339), utils.FormatSize(img.Size), orDash(strings.Join(use, ",")))
+		}
+		return w.Flush()
+	},
+}
+
+// imageGcCmd represents the image gc command
+var imageGcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove builder images no longer in use",
+	Long: `Remove the builder images built from older Dockerfiles. The image of
+the current Dockerfile and the one in tcb.lock are kept.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := lockWorkspace(); err != nil {
+			return err
+		}
+		images, err := container.Images()
+		if err != nil {
+			return runFailure(err)
+		}
+		current, locked, err := imagesInUse()
+		if err != nil {
+			return err
+		}
+		for _, img := range images {
+			if img.Tag == current || img.ID == locked {
+				continue
+			}
+			fmt.Printf("Removing %s (%s)\n", img.Tag, utils.FormatSize(img.Size))
+			if viper.GetBool("dryrun") {
+				continue
+			}
+			if err = container.RemoveImage(img.Tag); err != nil {
+				return runFailure(err)
+			}
+		}
+		return nil
+	},
+}
+
+// imagesInUse returns the tag of the image of the current Dockerfile, and
+// the id of the image in the lock file, if there is one
+func imagesInUse() (current, locked string, err error) {
+	if current, err = builder.ImageTag(); err != nil {
+		return "", "", err
+	}
+	if _, err = os.Stat(builder.LockFilePath()); os.IsNotExist(err) {
+		return current, "", nil
+	}
+	lf, err := builder.ReadLockFile()
+	if err != nil {
+		return "", "", fail(exitLocked, err)
+	}
+	return current, lf.Image, nil
+}
+
+func init() {
+	RootCmd.AddCommand(imageCmd)
+	imageCmd.AddCommand(imageShowCmd)
+	imageCmd.AddCommand(imageLsCmd)
+	imageCmd.AddCommand(imageGcCmd)
+}
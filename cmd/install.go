@@ -21,12 +21,13 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/staffano/tcb/builder"
-	"github.com/staffano/tcb/docker"
+	"github.com/staffano/tcb/container"
 	"github.com/staffano/tcb/workspace"
 )
 
@@ -34,48 +35,87 @@ import (
 var installCmd = &cobra.Command{
 	Use:   "install",
 	Short: "Install targets",
-	Run:   Install,
+	RunE:  Install,
 }
 
 func init() {
 	RootCmd.AddCommand(installCmd)
+	addJobsFlag(installCmd)
+	addOverrideFlags(installCmd)
+	addResourceFlags(installCmd)
+	addLockedFlag(installCmd)
 }
 
 // Install install the targets specified. If no target och "all" target is
 // specified then all known targets will be installed.
-func Install(cmd *cobra.Command, targets []string) {
+func Install(cmd *cobra.Command, targets []string) error {
+	if err := checkBuildFlags(); err != nil {
+		return err
+	}
+	if err := lockWorkspace(); err != nil {
+		return err
+	}
 	log.Printf("builder.Build(%v)", targets)
-	if !viper.GetBool("keep-sources") {
-		builder.CheckoutMetaCrosstools()
+	if err := prepareSources(); err != nil {
+		return err
+	}
+
+	// Build the targets and their dependencies first
+	order, err := buildTargets(targets)
+	if err != nil {
+		return err
 	}
 
 	if len(targets) == 0 || targets[0] == "all" {
-		allTargets := builder.GetAllTargets()
-		for _, t := range allTargets {
-			InstallTarget(t)
+		targets = order
+	}
+	for _, t := range targets {
+		if err = InstallTarget(t); err != nil {
+			return err
 		}
-	} else {
-		InstallTarget(targets[0])
 	}
+	return nil
 }
 
-// InstallTarget installs one target
-func InstallTarget(target string) {
-	stamp := target + ".install"
+// InstallTarget installs one target. A --dryrun leaves no stamp.
+func InstallTarget(target string) error {
+	stamp := builder.InstallStamp(target)
 
-	// Skip if already built
-	if workspace.GetStamp(stamp) {
-		return
+	// Build target first if it's not already built
+	if err := BuildTarget(target); err != nil {
+		return err
 	}
 
-	// Build target first if it's not already built
-	BuildTarget(target)
+	// A --dryrun build leaves no stamp, so there are no inputs unless the
+	// target was built before
+	dryrun := viper.GetBool("dryrun")
+	inputs, err := builder.InstallInputs(target)
+	if err != nil && !dryrun {
+		return err
+	}
+	// Skip if already installed from this build
+	if err == nil && workspace.GetStamp(stamp, inputs) == workspace.StampValid {
+		return nil
+	}
 
-	builder.SetTarget(target)
+	if err = builder.SetTarget(target); err != nil {
+		return err
+	}
 
 	// Run bitbake dockerized
-	workspace.MakeDir(0777, "results")
-	docker.Execute(workspace.Path("results"), workspace.Path("meta-crosstools"),
-		workspace.Path("build", "conf", "local.conf"), "bitbake", "-f", "-c", "do_copy_image", "image")
-	workspace.SetStamp(stamp)
+	if err = workspace.MakeDir(0777, "results"); err != nil {
+		return err
+	}
+	job, err := newJob(target)
+	if err != nil {
+		return err
+	}
+	if _, err = container.Execute(job, "bitbake", "-f", "-c", "do_copy_image", "image"); err != nil {
+		return runFailure(fmt.Errorf("installing %s: %w", target, err))
+	}
+	if dryrun {
+		// Nothing was installed
+		return nil
+	}
+	return workspace.SetStamp(stamp, workspace.NewStamp(inputs))
 }
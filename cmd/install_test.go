@@ -0,0 +1,58 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/staffano/tcb/builder"
+	"github.com/staffano/tcb/workspace"
+)
+
+func TestInstallTargetDryrun(t *testing.T) {
+	testWorkspace(t, "native")
+	viper.Set("dryrun", true)
+	defer viper.Set("dryrun", nil)
+
+	// Not built yet, so the build is a dryrun as well
+	if err := InstallTarget("native"); err != nil {
+		t.Fatalf("InstallTarget: %v", err)
+	}
+	if workspace.ReadStamp(builder.InstallStamp("native")) != nil {
+		t.Error("a dryrun install left a stamp")
+	}
+
+	// Built, only the install is a dryrun
+	buildInputs, err := builder.BuildInputs("native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = workspace.SetStamp(builder.BuildStamp("native"), workspace.NewStamp(buildInputs)); err != nil {
+		t.Fatal(err)
+	}
+	if err = InstallTarget("native"); err != nil {
+		t.Fatalf("InstallTarget: %v", err)
+	}
+	if workspace.ReadStamp(builder.InstallStamp("native")) != nil {
+		t.Error("a dryrun install of a built target left a stamp")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/staffano/tcb/builder"
+)
+
+// lockCmd represents the lock command
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Record the layer commits and builder image in tcb.lock",
+	Long: `Update the layers and the builder image, and record the commit of each
+layer, the id of the builder image and the bitbake revision in tcb.lock.
+Builds with --locked then use exactly these.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := lockWorkspace(); err != nil {
+			return err
+		}
+		if _, err := builder.Layers(); err != nil {
+			return fail(exitUsage, err)
+		}
+		if !viper.GetBool("keep-sources") {
+			if err := builder.CheckoutLayers(); err != nil {
+				return err
+			}
+		}
+		if err := buildImage(); err != nil {
+			return err
+		}
+		lf, err := builder.NewLockFile()
+		if err != nil {
+			return err
+		}
+		if err = lf.Write(); err != nil {
+			return err
+		}
+		for _, l := range lf.Layers {
+			fmt.Printf("%-20s %s\n", l.Name, l.Commit)
+		}
+		fmt.Printf("%-20s %s\n", "builder image", lf.Image)
+		fmt.Printf("%-20s %s\n", "bitbake", lf.Bitbake)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(lockCmd)
+}
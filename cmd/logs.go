@@ -0,0 +1,138 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/staffano/tcb/workspace"
+)
+
+// logsCmd represents the logs command
+var logsCmd = &cobra.Command{
+	Use:   "logs <target>",
+	Short: "Show the build logs of a target",
+	Long: `Show the log of the latest docker build or bitbake run of a target. The
+logs are kept in the workspace under logs/<target>. Use builder-image as
+target to see the logs of the builder image builds, and offline-check for
+the source checks of --offline builds.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fail(exitUsage, fmt.Errorf("logs needs the target to show logs of"))
+		}
+		return nil
+	},
+	RunE: Logs,
+}
+
+func init() {
+	RootCmd.AddCommand(logsCmd)
+	logsCmd.Flags().BoolP("follow", "f", false, "Keep printing the log as it grows, until the run finishes.")
+	logsCmd.Flags().Bool("failed", false, "Only consider runs that failed.")
+	logsCmd.Flags().Int("run", 1, "Show the Nth most recent run, 1 being the latest.")
+}
+
+// Logs prints a log of a target
+func Logs(cmd *cobra.Command, args []string) error {
+	target := args[0]
+	follow, _ := cmd.Flags().GetBool("follow")
+	failed, _ := cmd.Flags().GetBool("failed")
+	n, _ := cmd.Flags().GetInt("run")
+	if n < 1 {
+		return fail(exitUsage, fmt.Errorf("--run must be 1 or more"))
+	}
+
+	runs, err := workspace.Logs(target)
+	if err != nil {
+		return err
+	}
+	// Walk from the latest run backwards
+	var run *workspace.LogRun
+	for i := len(runs) - 1; i >= 0; i-- {
+		if failed && runs[i].Status != workspace.LogFailed {
+			continue
+		}
+		if n--; n == 0 {
+			run = &runs[i]
+			break
+		}
+	}
+	if run == nil {
+		what := "runs"
+		if failed {
+			what = "failed runs"
+		}
+		return fail(exitUsage, fmt.Errorf("%s doesn't have that many logged %s (%d logs in total)", target, what, len(runs)))
+	}
+
+	f, err := os.Open(run.Path)
+	if err != nil {
+		return &workspace.Error{Op: "open log", Path: run.Path, Err: err}
+	}
+	defer f.Close()
+	if !follow || run.Status != workspace.LogRunning {
+		_, err = io.Copy(os.Stdout, f)
+		return err
+	}
+	return followLog(f, run)
+}
+
+// How often followLog checks that the run is still going on
+var followCheckInterval = 5 * time.Second
+
+// followLog prints the lines of the log of run as they are written, until
+// the trailer of a finished run is seen. If the tcb writing the log dies
+// without finishing it, following stops once the log is read to its end.
+func followLog(f *os.File, run *workspace.LogRun) error {
+	r := bufio.NewReader(f)
+	partial := ""
+	checked := time.Now()
+	writerGone := !run.WriterAlive()
+	for {
+		line, err := r.ReadString('\n')
+		partial += line
+		if err == io.EOF {
+			if writerGone {
+				fmt.Print(partial)
+				return fmt.Errorf("the run ended without finishing its log, tcb was probably killed")
+			}
+			if time.Since(checked) >= followCheckInterval {
+				// Read what was written before the check once more
+				checked, writerGone = time.Now(), !run.WriterAlive()
+				continue
+			}
+			time.Sleep(500 * time.Millisecond)
+			continue
+		} else if err != nil {
+			return err
+		}
+		fmt.Print(partial)
+		if workspace.LogFinished(partial) {
+			return nil
+		}
+		partial = ""
+	}
+}
@@ -21,7 +21,12 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
 
 	"github.com/spf13/cobra"
 	"github.com/staffano/tcb/builder"
@@ -31,14 +36,73 @@ import (
 var lsCmd = &cobra.Command{
 	Use:   "ls",
 	Short: "list all toolchain targets",
-	Run:   List,
+	Long: `List all toolchain targets with their triplets, versions, dependencies and
+whether they are built and installed.
+
+The output can be consumed by scripts with --json, or formatted with a Go
+template given to --format, which is applied to each target. For example:
+
+  tcb ls --format '{{.Name}} {{.Target}} gcc-{{.GCC}}'`,
+	RunE: List,
 }
 
 func init() {
 	RootCmd.AddCommand(lsCmd)
+	lsCmd.Flags().Bool("json", false, "Print the targets as a JSON array.")
+	lsCmd.Flags().String("format", "", "Print each target using a Go template.")
 }
 
 // List all the targets within meta-crosstools
-func List(cmd *cobra.Command, args []string) {
-	fmt.Print(builder.GetAllTargets())
+func List(cmd *cobra.Command, args []string) error {
+	asJSON, _ := cmd.Flags().GetBool("json")
+	format, _ := cmd.Flags().GetString("format")
+
+	targets, err := builder.GetAllTargets()
+	if err != nil {
+		return err
+	}
+	var toolchains []*builder.Toolchain
+	for _, t := range targets {
+		tc, err := builder.GetToolchain(t)
+		if err != nil {
+			return err
+		}
+		toolchains = append(toolchains, tc)
+	}
+
+	switch {
+	case asJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(toolchains)
+	case format != "":
+		tmpl, err := template.New("format").Parse(format)
+		if err != nil {
+			return fail(exitUsage, fmt.Errorf("parsing --format: %w", err))
+		}
+		for _, tc := range toolchains {
+			if err = tmpl.Execute(os.Stdout, tc); err != nil {
+				return fail(exitUsage, err)
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tBUILD\tHOST\tTARGET\tGCC\tLIBC\tKERNEL\tDEPENDS\tBUILT\tINSTALLED")
+	for _, tc := range toolchains {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", tc.Name,
+			orDash(tc.Build), orDash(tc.Host), orDash(tc.Target),
+			orDash(tc.GCC), orDash(tc.Libc), orDash(tc.Kernel),
+			orDash(strings.Join(tc.Dependencies, ",")), tc.Built, tc.Installed)
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
 }
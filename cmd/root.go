@@ -21,9 +21,12 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
@@ -48,14 +51,29 @@ to quickly create a Cobra application.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := bindCommandFlags(cmd); err != nil {
+			return err
+		}
+		return initConfig()
+	},
+	// Errors are reported by Execute, together with the exit code
+	SilenceErrors: true,
+	SilenceUsage:  true,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// The exit code tells what kind of failure occurred, see errors.go.
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
-		log.Println(err)
-		os.Exit(1)
+	err := RootCmd.Execute()
+	if unlockErr := workspace.Unlock(); err == nil {
+		err = unlockErr
+	}
+	if err != nil {
+		code := exitCode(err)
+		fmt.Fprintf(os.Stderr, "tcb: %v\n", err)
+		os.Exit(code)
 	}
 }
 
@@ -66,27 +84,76 @@ func init() {
 	)
 	home, err = homedir.Dir()
 	if err != nil {
-		log.Fatalf("Could not determine homedir")
+		log.Printf("Could not determine homedir, using the current directory: %v", err)
 	}
 
-	cobra.OnInitialize(initConfig)
 	defaultWorkspace = path.Join(home, defaultWorkspaceName)
+	RootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		fmt.Fprint(os.Stderr, cmd.UsageString())
+		return fail(exitUsage, err)
+	})
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 	RootCmd.PersistentFlags().StringVar(&(workspace.Wd), "ws", defaultWorkspace, "workspace (default is "+defaultWorkspace+")")
 	RootCmd.PersistentFlags().StringP("builder.repo.url", "", "https://github.com/staffano/meta-crosstools.git", "Repository to use for builder.")
 	viper.BindPFlag("builder.repo.url", RootCmd.PersistentFlags().Lookup("builder.repo.url"))
-	RootCmd.PersistentFlags().StringP("builder.repo.rev", "", "master", "Revision to use of the builder repo.")
+	RootCmd.PersistentFlags().StringP("builder.repo.rev", "", "master", "Branch, tag or commit to use of the builder repo.")
 	viper.BindPFlag("builder.repo.rev", RootCmd.PersistentFlags().Lookup("builder.repo.rev"))
+	RootCmd.PersistentFlags().StringP("builder.path", "", "", "Local checkout of the builder repo to use in place, instead of cloning builder.repo.url.")
+	viper.BindPFlag("builder.path", RootCmd.PersistentFlags().Lookup("builder.path"))
 	RootCmd.PersistentFlags().BoolP("keep-sources", "", false, "If set, git pull will not be called for the source directory")
 	viper.BindPFlag("keep-sources", RootCmd.PersistentFlags().Lookup("keep-sources"))
+	RootCmd.PersistentFlags().StringP("runtime", "", "docker", "Runtime to build in: docker, podman or native (host bitbake, linux only).")
+	viper.BindPFlag("runtime", RootCmd.PersistentFlags().Lookup("runtime"))
+	RootCmd.PersistentFlags().BoolP("wait", "", false, "If the workspace is busy, wait for it instead of failing.")
+	viper.BindPFlag("wait", RootCmd.PersistentFlags().Lookup("wait"))
+	RootCmd.PersistentFlags().BoolP("offline", "", false, "Never access the network, and fail listing what is missing if an input has to be fetched.")
+	viper.BindPFlag("offline", RootCmd.PersistentFlags().Lookup("offline"))
 	RootCmd.PersistentFlags().BoolP("dryrun", "", false, "If set, build commands will not be executed, but printed to stdout instead.")
 	viper.BindPFlag("dryrun", RootCmd.PersistentFlags().Lookup("dryrun"))
 }
 
+// commandFlags maps flags defined by several commands to their config keys.
+// A viper key can only be bound to one flag, so they are bound when the
+// command runs.
+var commandFlags = map[string]string{
+	"jobs":      "jobs",
+	"set":       "set",
+	"append":    "append",
+	"cpus":      "container.cpus",
+	"memory":    "container.memory",
+	"threads":   "parallel.threads",
+	"make-jobs": "parallel.make-jobs",
+	"locked":    "locked",
+}
+
+func bindCommandFlags(cmd *cobra.Command) error {
+	for name, key := range commandFlags {
+		if f := cmd.Flags().Lookup(name); f != nil {
+			if err := viper.BindPFlag(key, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// invocationDir is the working directory tcb was started in, before it
+// changed to the workspace
+var invocationDir string
+
+// invocationPath resolves a path given on the command line relative to the
+// directory tcb was started in
+func invocationPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(invocationDir, p)
+}
+
 // initConfig reads in config file and ENV variables if set.
-func initConfig() {
+func initConfig() error {
 
 	if workspace.Wd != "" {
 		// Use config file from the flag.
@@ -94,14 +161,36 @@ func initConfig() {
 		viper.AddConfigPath(workspace.Wd)
 	}
 
-	workspace.InitWorkspace()
+	// The workspace becomes the working directory, so resolve a relative
+	// --builder.path before that
+	invocationDir, _ = os.Getwd()
+	if p := viper.GetString("builder.path"); p != "" && !filepath.IsAbs(p) {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return fail(exitUsage, err)
+		}
+		viper.Set("builder.path", abs)
+	}
+
+	if err := workspace.InitWorkspace(); err != nil {
+		return err
+	}
 
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		log.Printf("Read config file %s", viper.ConfigFileUsed())
-	} else {
+	} else if _, ok := err.(viper.ConfigFileNotFoundError); ok {
 		log.Printf("Not using config file")
+	} else {
+		return fail(exitUsage, fmt.Errorf("reading config file: %w", err))
 	}
+	return nil
+}
+
+// lockWorkspace takes the workspace lock for commands that change the
+// workspace. It is released by Execute when the command is done.
+func lockWorkspace() error {
+	return workspace.Lock(strings.Join(os.Args, " "), viper.GetBool("wait"))
 }
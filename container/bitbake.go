@@ -0,0 +1,202 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"github.com/staffano/tcb/git"
+)
+
+func init() {
+	viper.SetDefault("bitbake.url", "https://github.com/openembedded/bitbake.git")
+	// The bitbake release meta-crosstools is known to work with
+	viper.SetDefault("bitbake.rev", "1.36.0")
+}
+
+// The labels of the builder image recording its bitbake. The rev is the
+// bitbake.rev the image was built with, and the commit what it resolved to.
+const (
+	bitbakeRevLabel    = containerLabel + ".bitbake.rev"
+	bitbakeCommitLabel = containerLabel + ".bitbake.commit"
+)
+
+// bitbakeCommitArg is the build argument giving the commit of bitbake to
+// check out in the builder image
+const bitbakeCommitArg = "BITBAKE_COMMIT"
+
+// The commits bitbake revisions have been resolved to, by url and rev, so
+// each is only resolved once per run
+var (
+	resolvedMu      sync.Mutex
+	resolvedBitbake = map[string]string{}
+)
+
+// bitbakeCommit returns the commit of bitbake.rev the builder image of
+// dockerfile is built with, which the native runtime doesn't have. Online
+// bitbake.rev is resolved in bitbake.url, so a moved branch gives a new
+// image. Offline the commit is taken from the local builder image of
+// dockerfile with a bitbake of bitbake.rev.
+func bitbakeCommit(rt Runtime, dockerfile string) (string, error) {
+	if _, native := rt.(*nativeRuntime); native {
+		return "", nil
+	}
+	url, rev := viper.GetString("bitbake.url"), viper.GetString("bitbake.rev")
+	if Offline() {
+		return localBitbakeCommit(rt, dockerfile, rev)
+	}
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+	key := url + " " + rev
+	if commit, ok := resolvedBitbake[key]; ok {
+		return commit, nil
+	}
+	commit, err := git.ResolveRemote(url, rev)
+	if err != nil {
+		return "", &ImageError{Err: fmt.Errorf("resolving bitbake.rev: %w", err)}
+	}
+	resolvedBitbake[key] = commit
+	return commit, nil
+}
+
+// localBitbakeCommit returns the bitbake commit of the newest builder image
+// of dockerfile built with bitbake rev, or an OfflineError if there is none
+func localBitbakeCommit(rt Runtime, dockerfile, rev string) (string, error) {
+	images, err := rt.ListImages(imageName)
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Created.After(images[j].Created)
+	})
+	for _, img := range images {
+		labels, err := rt.ImageLabels(img.Tag)
+		if err != nil {
+			return "", err
+		}
+		commit := labels[bitbakeCommitLabel]
+		if commit != "" && labels[bitbakeRevLabel] == rev && imageTag(dockerfile, commit) == img.Tag {
+			return commit, nil
+		}
+	}
+	return "", &OfflineError{Missing: []string{fmt.Sprintf("image %s with bitbake %s", imageName, rev)}}
+}
+
+// BitbakeError is returned when the bitbake of the builder image is not
+// the one bitbake.rev asks for
+type BitbakeError struct {
+	Rev    string
+	Commit string
+}
+
+func (e *BitbakeError) Error() string {
+	return fmt.Sprintf("the builder image has bitbake %s, but bitbake.rev is %s", e.Commit, e.Rev)
+}
+
+// bitbakeRevCmd prints the commit of the bitbake found in PATH, and the
+// commit of the revision given as $1 in its repository if it is known
+// there
+const bitbakeRevCmd = `cd "$(dirname "$(dirname "$(readlink -f "$(command -v bitbake)")")")" && git rev-parse HEAD && ` +
+	`{ git rev-parse -q --verify "$1^{commit}" || git rev-parse -q --verify "origin/$1^{commit}" || true; }`
+
+// bitbakeCommits returns the commit of the bitbake in the builder image
+// tag, and the commit of rev in its repository, or "" if it is unknown
+// there. It runs git in the image.
+func bitbakeCommits(rt Runtime, tag, rev string) (head, want string, err error) {
+	var out bytes.Buffer
+	spec := &RunSpec{
+		Image:  tag,
+		Cmd:    []string{"sh", "-c", bitbakeRevCmd, "sh", rev},
+		Env:    getProxyArgs(),
+		Prefix: rt.Name() + " run bitbake revision",
+		Stdout: &out,
+	}
+	if _, err = rt.Run(spec); err != nil {
+		return "", "", fmt.Errorf("resolving the bitbake revision: %w", err)
+	}
+	lines := strings.Fields(out.String())
+	if len(lines) == 0 {
+		return "", "", fmt.Errorf("resolving the bitbake revision: no output")
+	}
+	if len(lines) > 1 {
+		want = lines[1]
+	}
+	return lines[0], want, nil
+}
+
+// BitbakeRevision returns the commit of the bitbake in the builder image
+// tag. It is read from the labels of the image, when it has them.
+func BitbakeRevision(tag string) (string, error) {
+	rt, err := Get()
+	if err != nil {
+		return "", err
+	}
+	labels, err := rt.ImageLabels(tag)
+	if err != nil {
+		return "", err
+	}
+	if commit := labels[bitbakeCommitLabel]; commit != "" {
+		return commit, nil
+	}
+	head, _, err := bitbakeCommits(rt, tag, "HEAD")
+	return head, err
+}
+
+// CheckBitbake returns a BitbakeError if the bitbake in the builder image
+// tag is not the one of bitbake.rev, and otherwise its commit. Images
+// without the labels, like the host of the native runtime, are checked by
+// running git in them. When that is not possible, a warning is logged.
+func CheckBitbake(tag string) (string, error) {
+	rt, err := Get()
+	if err != nil {
+		return "", err
+	}
+	rev := viper.GetString("bitbake.rev")
+	labels, err := rt.ImageLabels(tag)
+	if err != nil {
+		return "", err
+	}
+	if commit := labels[bitbakeCommitLabel]; commit != "" {
+		if labels[bitbakeRevLabel] != rev {
+			return "", &BitbakeError{Rev: rev, Commit: fmt.Sprintf("%s (%s)", labels[bitbakeRevLabel], commit)}
+		}
+		return commit, nil
+	}
+	head, want, err := bitbakeCommits(rt, tag, rev)
+	if err != nil {
+		log.Printf("Warning: can't tell if the bitbake of %s is %s: %v", tag, rev, err)
+		return "", nil
+	}
+	if want == "" {
+		log.Printf("Warning: can't tell if bitbake %s is %s, it is unknown to its repository", head, rev)
+		return head, nil
+	}
+	if head != want {
+		return "", &BitbakeError{Rev: rev, Commit: head}
+	}
+	return head, nil
+}
@@ -0,0 +1,94 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package container
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// SaveImage writes the builder image tag to w, as a tar archive
+func SaveImage(tag string, w io.Writer) error {
+	rt, err := Get()
+	if err != nil {
+		return err
+	}
+	if err = rt.SaveImage(tag, w); err != nil {
+		return fmt.Errorf("saving the builder image %s: %w", tag, err)
+	}
+	return nil
+}
+
+// LoadImage loads a builder image written by SaveImage
+func LoadImage(r io.Reader) error {
+	rt, err := Get()
+	if err != nil {
+		return err
+	}
+	if err = rt.LoadImage(r); err != nil {
+		return fmt.Errorf("loading the builder image: %w", err)
+	}
+	return nil
+}
+
+// downloadsSpec returns a spec running cmd in the builder image tag, with
+// the downloads volume at /build/downloads and the host directory dir at
+// /build/bundle. The commands run in /build.
+func downloadsSpec(rt Runtime, tag, dir string, cmd ...string) *RunSpec {
+	return &RunSpec{
+		Image: tag,
+		Cmd:   cmd,
+		Mounts: []Mount{
+			{Volume: true, Source: downloadVol, Target: "/build/downloads"},
+			{Source: dir, Target: "/build/bundle"},
+		},
+		Prefix: rt.Name() + " run downloads",
+	}
+}
+
+// ExportDownloads writes the contents of the downloads volume to the tar
+// archive file, using the builder image tag to read the volume
+func ExportDownloads(tag, file string) error {
+	rt, err := Get()
+	if err != nil {
+		return err
+	}
+	spec := downloadsSpec(rt, tag, filepath.Dir(file), "tar", "-C", "downloads", "-cf", "bundle/"+filepath.Base(file), ".")
+	if _, err = rt.Run(spec); err != nil {
+		return fmt.Errorf("exporting %s: %w", downloadVol, err)
+	}
+	return nil
+}
+
+// ImportDownloads extracts the tar archive file, written by ExportDownloads,
+// into the downloads volume. Files already in the volume are replaced.
+func ImportDownloads(tag, file string) error {
+	rt, err := Get()
+	if err != nil {
+		return err
+	}
+	spec := downloadsSpec(rt, tag, filepath.Dir(file), "tar", "-C", "downloads", "-xf", "bundle/"+filepath.Base(file))
+	if _, err = rt.Run(spec); err != nil {
+		return fmt.Errorf("importing %s: %w", downloadVol, err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/staffano/tcb/docker"
+)
+
+func init() {
+	register("docker", newDockerRuntime)
+}
+
+// dockerRuntime talks to the Docker Engine API
+type dockerRuntime struct {
+	c *docker.Client
+}
+
+func newDockerRuntime() (Runtime, error) {
+	c, err := docker.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	return &dockerRuntime{c: c}, nil
+}
+
+func (d *dockerRuntime) Name() string {
+	return "docker"
+}
+
+func (d *dockerRuntime) containerConfig(spec *RunSpec) *docker.ContainerConfig {
+	cfg := &docker.ContainerConfig{
+		Image:        spec.Image,
+		Cmd:          spec.Cmd,
+		Env:          spec.Env,
+		Labels:       map[string]string{containerLabel: "true"},
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	cfg.HostConfig.NanoCPUs = int64(spec.CPUs * 1e9)
+	cfg.HostConfig.Memory = spec.Memory
+	if spec.NoNetwork {
+		cfg.HostConfig.NetworkMode = "none"
+	}
+	for _, m := range spec.Mounts {
+		t := "bind"
+		if m.Volume {
+			t = "volume"
+		}
+		cfg.HostConfig.Mounts = append(cfg.HostConfig.Mounts,
+			docker.Mount{Type: t, Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly})
+	}
+	return cfg
+}
+
+func printDryrun(cfg *docker.ContainerConfig) {
+	b, _ := json.MarshalIndent(cfg, "", "  ")
+	fmt.Printf("POST /containers/create\n%s\n", b)
+}
+
+func (d *dockerRuntime) BuildImage(dockerfile, tag string, buildArgs map[string]string, buildLog io.Writer) error {
+	out := newLineWriter("OUT", "docker build", buildLog)
+	defer out.Close()
+	_, err := d.c.BuildImage(dockerfile, tag, buildArgs, func(l string) {
+		fmt.Fprintln(out, l)
+	})
+	return err
+}
+
+func (d *dockerRuntime) Run(spec *RunSpec) (RunResult, error) {
+	var res RunResult
+
+	cfg := d.containerConfig(spec)
+	if viper.GetBool("dryrun") {
+		printDryrun(cfg)
+		return res, nil
+	}
+
+	id, err := d.c.CreateContainer(cfg)
+	if err != nil {
+		return res, err
+	}
+	res.ContainerID = docker.ShortID(id)
+	defer d.c.RemoveContainer(id, true)
+	stop := d.stopOnInterrupt(id)
+	defer stop()
+
+	if err = d.c.StartContainer(id); err != nil {
+		return res, err
+	}
+
+	var stdout io.Writer = spec.Stdout
+	if stdout == nil {
+		lw := newLineWriter("OUT", spec.Prefix, spec.Log)
+		defer lw.Close()
+		stdout = lw
+	}
+	stderr := newLineWriter("ERR", spec.Prefix, spec.Log)
+	err = d.c.ContainerLogs(id, stdout, stderr)
+	stderr.Close()
+	if err != nil {
+		return res, err
+	}
+
+	if res.ExitCode, err = d.c.WaitContainer(id); err != nil {
+		return res, err
+	}
+	if res.ExitCode != 0 {
+		return res, &ExitError{ContainerID: res.ContainerID, ExitCode: res.ExitCode}
+	}
+	return res, nil
+}
+
+func (d *dockerRuntime) Shell(spec *RunSpec) error {
+	cfg := d.containerConfig(spec)
+	cfg.AttachStdin = true
+	cfg.OpenStdin = true
+	cfg.StdinOnce = true
+
+	if viper.GetBool("dryrun") {
+		printDryrun(cfg)
+		return nil
+	}
+
+	id, err := d.c.CreateContainer(cfg)
+	if err != nil {
+		return err
+	}
+	defer d.c.RemoveContainer(id, true)
+
+	conn, br, err := d.c.AttachContainer(id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = d.c.StartContainer(id); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	docker.Demux(br, os.Stdout, os.Stderr)
+
+	code, err := d.c.WaitContainer(id)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return &ExitError{ContainerID: docker.ShortID(id), ExitCode: code}
+	}
+	return nil
+}
+
+func (d *dockerRuntime) RemoveContainers() ([]string, error) {
+	var removed []string
+	containers, err := d.c.ListContainers(containerLabel)
+	if err != nil {
+		return nil, err
+	}
+	for _, ct := range containers {
+		if err = d.c.RemoveContainer(ct.ID, true); err != nil {
+			return removed, err
+		}
+		removed = append(removed, docker.ShortID(ct.ID))
+	}
+	return removed, nil
+}
+
+func (d *dockerRuntime) ListVolumes(prefix string) ([]string, error) {
+	return d.c.ListVolumes(prefix)
+}
+
+func (d *dockerRuntime) RemoveVolumes(names ...string) error {
+	for _, n := range names {
+		if _, err := d.c.RemoveVolume(n, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dockerRuntime) RemoveImage(name string) error {
+	if err := d.c.RemoveImage(name, true); err != nil && !docker.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *dockerRuntime) ImageID(name string) (string, error) {
+	info, err := d.c.InspectImage(name)
+	if docker.IsNotFound(err) {
+		return "", &NoImageError{Name: name}
+	} else if err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+func (d *dockerRuntime) ImageLabels(name string) (map[string]string, error) {
+	info, err := d.c.InspectImage(name)
+	if err != nil {
+		return nil, err
+	}
+	return info.Config.Labels, nil
+}
+
+func (d *dockerRuntime) SaveImage(name string, w io.Writer) error {
+	return d.c.SaveImage(name, w)
+}
+
+func (d *dockerRuntime) LoadImage(r io.Reader) error {
+	return d.c.LoadImage(r)
+}
+
+func (d *dockerRuntime) ListImages(repository string) ([]Image, error) {
+	summaries, err := d.c.ListImages(repository)
+	if err != nil {
+		return nil, err
+	}
+	var images []Image
+	for _, s := range summaries {
+		for _, tag := range s.RepoTags {
+			if strings.HasPrefix(tag, repository+":") {
+				images = append(images, Image{ID: s.ID, Tag: tag, Created: time.Unix(s.Created, 0), Size: s.Size})
+			}
+		}
+	}
+	return images, nil
+}
+
+// stopOnInterrupt stops the container if tcb is interrupted, so we don't
+// leave bitbake running in the background. The returned function cancels
+// the signal handling.
+func (d *dockerRuntime) stopOnInterrupt(id string) func() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		select {
+		case <-sigs:
+			fmt.Fprintf(os.Stderr, "Interrupted, stopping container %s\n", docker.ShortID(id))
+			d.c.StopContainer(id, 10)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
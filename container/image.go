@@ -0,0 +1,299 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package container
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/staffano/tcb/utils"
+	"github.com/staffano/tcb/workspace"
+)
+
+func init() {
+	viper.SetDefault("image.base", "ubuntu")
+	viper.SetDefault("image.packages", []string{})
+}
+
+// imageName is the repository of the builder images. They are tagged with
+// a hash of what they are built from, see ImageTag.
+const imageName = "meta_crosstools_bitbake"
+
+// Image is a builder image
+type Image struct {
+	ID      string    `json:"id"`
+	Tag     string    `json:"tag"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+}
+
+// The files customizing the builder image, relative to the workspace or
+// the builder layer. DockerfileOverride replaces the template below and
+// DockerfileExtension is added to it. Both are templates themselves.
+const (
+	DockerfileOverride  = "image/Dockerfile"
+	DockerfileExtension = "image/Dockerfile.extend"
+)
+
+// The packages always installed in the builder image
+var basePackages = []string{"build-essential", "gnat-5", "git", "locales", "python3", "wget", "m4", "gawk", "unzip", "nano", "texinfo"}
+
+var dockerTemplate = `FROM {{.Base}}
+RUN apt update -y && apt upgrade -y
+RUN apt install -y {{join .Packages " "}}
+RUN locale-gen en_US.UTF-8
+ARG BITBAKE_COMMIT
+RUN git clone {{.BitbakeURL}} /bitbake && git -C /bitbake checkout --detach ${BITBAKE_COMMIT}
+LABEL nu.diversum.tcb.bitbake.rev="{{.BitbakeRev}}" nu.diversum.tcb.bitbake.commit="${BITBAKE_COMMIT}"
+ENV LANG en_US.UTF-8
+ENV PATH /bitbake/bin:$PATH
+ENV PYTHONPATH /bitbake/lib:$PYTHONPATH
+RUN mkdir -p /build/conf
+VOLUME /build/tmp
+{{range .Extensions}}{{.}}{{end}}WORKDIR /build
+CMD ["bitbake", "--help"]
+#ENTRYPOINT [ "/build.sh"]
+`
+
+// imageData is what the Dockerfile templates are rendered with
+type imageData struct {
+	// Base is the base image, from the image.base config key
+	Base string
+	// Packages are the packages to install, the extra ones of the
+	// image.packages config key included
+	Packages []string
+	// BitbakeURL and BitbakeRev are the repository and revision of
+	// bitbake, from the bitbake.url and bitbake.rev config keys. The
+	// revision is resolved to a commit given by the BITBAKE_COMMIT build
+	// argument.
+	BitbakeURL string
+	BitbakeRev string
+	// Extensions are the rendered extension files
+	Extensions []string
+}
+
+var templateFuncs = template.FuncMap{"join": strings.Join}
+
+func render(name, text string, data *imageData) (string, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err = t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// readOptional returns the contents of file, or "" if it doesn't exist
+func readOptional(file string) (string, bool, error) {
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	return string(content), err == nil, err
+}
+
+// RenderDockerfile renders the Dockerfile of the builder image. Each of dirs
+// may hold a DockerfileOverride and a DockerfileExtension. An override in a
+// later dir wins over earlier ones, while all extensions are added, in the
+// order of dirs. It also returns the files used.
+func RenderDockerfile(dirs ...string) (string, []string, error) {
+	var (
+		sources []string
+		name    = "Dockerfile"
+		text    = dockerTemplate
+	)
+	data := &imageData{
+		Base:       viper.GetString("image.base"),
+		Packages:   append(append([]string{}, basePackages...), viper.GetStringSlice("image.packages")...),
+		BitbakeURL: viper.GetString("bitbake.url"),
+		BitbakeRev: viper.GetString("bitbake.rev"),
+	}
+
+	for _, dir := range dirs {
+		file := filepath.Join(dir, DockerfileOverride)
+		content, ok, err := readOptional(file)
+		if err != nil {
+			return "", nil, &ImageError{Err: err}
+		}
+		if ok {
+			name, text = file, content
+			sources = []string{file}
+		}
+	}
+	for _, dir := range dirs {
+		file := filepath.Join(dir, DockerfileExtension)
+		content, ok, err := readOptional(file)
+		if err != nil {
+			return "", nil, &ImageError{Err: err}
+		}
+		if !ok {
+			continue
+		}
+		ext, err := render(file, content, data)
+		if err != nil {
+			return "", nil, &ImageError{Err: err}
+		}
+		if !strings.HasSuffix(ext, "\n") {
+			ext += "\n"
+		}
+		data.Extensions = append(data.Extensions, fmt.Sprintf("# From %s\n%s", file, ext))
+		sources = append(sources, file)
+	}
+
+	dockerfile, err := render(name, text, data)
+	if err != nil {
+		return "", nil, &ImageError{Err: err}
+	}
+	return dockerfile, sources, nil
+}
+
+// ImageTag returns the tag of the builder image built from dockerfile. It
+// is a hash of the Dockerfile and the commit of bitbake it is built with,
+// so an image that is up to date can be found by its tag. The proxy
+// settings of the host are left out, they don't change what is built.
+func ImageTag(dockerfile string) (string, error) {
+	rt, err := Get()
+	if err != nil {
+		return "", err
+	}
+	commit, err := bitbakeCommit(rt, dockerfile)
+	if err != nil {
+		return "", err
+	}
+	return imageTag(dockerfile, commit), nil
+}
+
+// imageTag returns the tag of the builder image built from dockerfile with
+// the bitbake commit. The native runtime has no commit.
+func imageTag(dockerfile, commit string) string {
+	if commit != "" {
+		dockerfile += "\nARG " + bitbakeCommitArg + "=" + commit
+	}
+	return imageName + ":" + utils.HashString(dockerfile)[:12]
+}
+
+// ImageLog is the name the logs of the builder image builds are kept under
+const ImageLog = "builder-image"
+
+// BuildImage creates the image we will base our container on from
+// dockerfile, see RenderDockerfile, unless it already exists. It returns
+// the tag of the image.
+func BuildImage(dockerfile string) (string, error) {
+	rt, err := Get()
+	if err != nil {
+		return "", err
+	}
+	commit, err := bitbakeCommit(rt, dockerfile)
+	if err != nil {
+		return "", err
+	}
+	tag := imageTag(dockerfile, commit)
+	if exists, err := imageExists(rt, tag); err != nil {
+		return "", err
+	} else if exists {
+		log.Printf("Builder image %s is up to date", tag)
+		return tag, nil
+	}
+	// The host is the image of the native runtime, there is nothing to
+	// fetch
+	_, native := rt.(*nativeRuntime)
+	if Offline() && !native {
+		return "", &OfflineError{Missing: []string{"image " + tag}}
+	}
+	if viper.GetBool("dryrun") {
+		fmt.Printf("%s build %s\n", rt.Name(), tag)
+		return tag, nil
+	}
+	args := getBuildArgs()
+	if commit != "" {
+		log.Printf("Building the builder image with bitbake %s", commit)
+		args[bitbakeCommitArg] = commit
+	}
+	l, err := workspace.OpenLog(ImageLog, rt.Name()+" build "+tag, viper.GetInt("logs.keep"))
+	if err != nil {
+		return "", err
+	}
+	if err = rt.BuildImage(dockerfile, tag, args, l); err != nil {
+		err = &ImageError{Err: err}
+	}
+	if finishErr := l.Finish(err); err == nil {
+		err = finishErr
+	}
+	return tag, err
+}
+
+// imageExists returns true if the image tag exists. Only a NoImageError
+// means it doesn't, any other error is returned, as the runtime failed.
+func imageExists(rt Runtime, tag string) (bool, error) {
+	id, err := rt.ImageID(tag)
+	var noImage *NoImageError
+	if errors.As(err, &noImage) {
+		return false, nil
+	}
+	return id != "", err
+}
+
+// ImageID returns the id of the builder image tag
+func ImageID(tag string) (string, error) {
+	rt, err := Get()
+	if err != nil {
+		return "", err
+	}
+	return rt.ImageID(tag)
+}
+
+// Images lists the builder images, the newest first
+func Images() ([]Image, error) {
+	rt, err := Get()
+	if err != nil {
+		return nil, err
+	}
+	images, err := rt.ListImages(imageName)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Created.After(images[j].Created)
+	})
+	return images, nil
+}
+
+// RemoveImage removes the builder image tag
+func RemoveImage(tag string) error {
+	rt, err := Get()
+	if err != nil {
+		return err
+	}
+	return rt.RemoveImage(tag)
+}
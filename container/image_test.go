@@ -0,0 +1,248 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/staffano/tcb/workspace"
+)
+
+// fakeImage is an image of fakeRuntime
+type fakeImage struct {
+	Image
+	labels map[string]string
+}
+
+// fakeRuntime keeps images in memory. Building one labels it with the
+// bitbake it is built with, like the Dockerfile template does.
+type fakeRuntime struct {
+	images map[string]*fakeImage
+	builds int
+	// err is returned by ImageID, if set
+	err error
+	// output is written to the log by Run, which then fails if it is set
+	output string
+}
+
+var fake = &fakeRuntime{}
+
+func init() {
+	register("fake", func() (Runtime, error) { return fake, nil })
+}
+
+func (f *fakeRuntime) Name() string { return "fake" }
+
+func (f *fakeRuntime) BuildImage(dockerfile, tag string, buildArgs map[string]string, buildLog io.Writer) error {
+	f.builds++
+	f.images[tag] = &fakeImage{
+		Image: Image{ID: fmt.Sprintf("sha256:%d", f.builds), Tag: tag, Created: time.Unix(int64(f.builds), 0)},
+		labels: map[string]string{
+			bitbakeRevLabel:    viper.GetString("bitbake.rev"),
+			bitbakeCommitLabel: buildArgs[bitbakeCommitArg],
+		},
+	}
+	return nil
+}
+
+func (f *fakeRuntime) Run(spec *RunSpec) (RunResult, error) {
+	if f.output == "" {
+		return RunResult{}, nil
+	}
+	io.WriteString(spec.Log, f.output)
+	return RunResult{}, &ExitError{ContainerID: "fake", ExitCode: 1}
+}
+
+func (f *fakeRuntime) Shell(spec *RunSpec) error           { return nil }
+func (f *fakeRuntime) RemoveContainers() ([]string, error) { return nil, nil }
+func (f *fakeRuntime) ListVolumes(prefix string) ([]string, error) {
+	return nil, nil
+}
+func (f *fakeRuntime) RemoveVolumes(names ...string) error { return nil }
+func (f *fakeRuntime) RemoveImage(name string) error {
+	delete(f.images, name)
+	return nil
+}
+
+func (f *fakeRuntime) ListImages(repository string) ([]Image, error) {
+	var images []Image
+	for _, img := range f.images {
+		images = append(images, img.Image)
+	}
+	return images, nil
+}
+
+func (f *fakeRuntime) ImageID(name string) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	if img, ok := f.images[name]; ok {
+		return img.ID, nil
+	}
+	return "", &NoImageError{Name: name}
+}
+
+func (f *fakeRuntime) ImageLabels(name string) (map[string]string, error) {
+	if img, ok := f.images[name]; ok {
+		return img.labels, nil
+	}
+	return nil, fmt.Errorf("no such image %s", name)
+}
+
+func (f *fakeRuntime) SaveImage(name string, w io.Writer) error { return nil }
+func (f *fakeRuntime) LoadImage(r io.Reader) error              { return nil }
+
+// setConfig sets a config key for the duration of the test
+func setConfig(t *testing.T, key string, value interface{}) {
+	t.Helper()
+	old := viper.Get(key)
+	viper.Set(key, value)
+	t.Cleanup(func() { viper.Set(key, old) })
+}
+
+// testBitbake sets up a workspace, the fake runtime and a bitbake
+// repository. The returned function commits to master of the repository
+// and returns the commit.
+func testBitbake(t *testing.T) func() string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tcb-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	oldWd := workspace.Wd
+	workspace.Wd = dir
+	t.Cleanup(func() { workspace.Wd = oldWd })
+
+	fake.images, fake.builds, fake.err, fake.output = map[string]*fakeImage{}, 0, nil, ""
+	resolvedBitbake = map[string]string{}
+	repo := filepath.Join(dir, "bitbake")
+	setConfig(t, "runtime", "fake")
+	setConfig(t, "bitbake.url", repo)
+	setConfig(t, "bitbake.rev", "master")
+
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t",
+			"GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if err = os.Mkdir(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q", "-b", "master")
+	return func() string {
+		git("commit", "-q", "--allow-empty", "-m", "commit")
+		return git("rev-parse", "HEAD")
+	}
+}
+
+func TestImageTagFollowsBitbake(t *testing.T) {
+	commit := testBitbake(t)
+	const dockerfile = "FROM ubuntu\n"
+
+	first := commit()
+	tag, err := BuildImage(dockerfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.images[tag].labels[bitbakeCommitLabel]; got != first {
+		t.Errorf("built with bitbake %s, want %s", got, first)
+	}
+	if again, err := BuildImage(dockerfile); err != nil || again != tag || fake.builds != 1 {
+		t.Errorf("rebuilt an up to date image: %s, %v, %d builds", again, err, fake.builds)
+	}
+
+	// The branch moves in the next run
+	second := commit()
+	resolvedBitbake = map[string]string{}
+	moved, err := BuildImage(dockerfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == tag {
+		t.Errorf("the image %s was reused after bitbake.rev moved", tag)
+	}
+	if got := fake.images[moved].labels[bitbakeCommitLabel]; got != second {
+		t.Errorf("built with bitbake %s, want %s", got, second)
+	}
+
+	// Offline the newest image of bitbake.rev is used
+	setConfig(t, "offline", true)
+	if offline, err := ImageTag(dockerfile); err != nil || offline != moved {
+		t.Errorf("offline ImageTag = %s, %v, want %s", offline, err, moved)
+	}
+	setConfig(t, "bitbake.rev", "other")
+	var offErr *OfflineError
+	if _, err = ImageTag(dockerfile); !errors.As(err, &offErr) {
+		t.Errorf("offline ImageTag of another bitbake.rev = %v, want an OfflineError", err)
+	}
+}
+
+func TestBuildImageRuntimeError(t *testing.T) {
+	commit := testBitbake(t)
+	commit()
+	fake.err = errors.New("cannot connect to the engine")
+
+	_, err := BuildImage("FROM ubuntu\n")
+	var imgErr *ImageError
+	if !errors.Is(err, fake.err) || errors.As(err, &imgErr) {
+		t.Errorf("BuildImage = %v, want the runtime error", err)
+	}
+	if fake.builds != 0 {
+		t.Errorf("BuildImage built an image when the runtime failed")
+	}
+}
+
+func TestHasImage(t *testing.T) {
+	commit := testBitbake(t)
+	commit()
+	tag, err := BuildImage("FROM ubuntu\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := HasImage(tag); !ok || err != nil {
+		t.Errorf("HasImage(%s) = %t, %v", tag, ok, err)
+	}
+	if ok, err := HasImage(imageName + ":missing"); ok || err != nil {
+		t.Errorf("HasImage of a missing image = %t, %v", ok, err)
+	}
+	fake.err = errors.New("cannot connect to the engine")
+	if _, err := HasImage(tag); !errors.Is(err, fake.err) {
+		t.Errorf("HasImage with the runtime failing = %v, want its error", err)
+	}
+}
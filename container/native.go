@@ -0,0 +1,235 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package container
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/staffano/tcb/workspace"
+)
+
+func init() {
+	register("native", newNativeRuntime)
+}
+
+// nativeRuntime runs bitbake directly on a Linux host that already has
+// bitbake and the packages of the builder image installed. The mounts of a
+// RunSpec are laid out as symlinks in a host build directory, so the
+// commands see the same /build structure as inside the container.
+type nativeRuntime struct {
+	bitbake string
+}
+
+func newNativeRuntime() (Runtime, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("the native runtime is only supported on linux hosts")
+	}
+	bitbake, err := exec.LookPath("bitbake")
+	if err != nil {
+		return nil, fmt.Errorf("native runtime selected, but bitbake is not in PATH: %v", err)
+	}
+	return &nativeRuntime{bitbake: bitbake}, nil
+}
+
+func (n *nativeRuntime) Name() string {
+	return "native"
+}
+
+// buildDir is the host counterpart of /build in the container. Each job
+// has its own local.conf, so the build directory is placed where the
+// local.conf is, keeping concurrent jobs apart.
+func (n *nativeRuntime) buildDir(spec *RunSpec) string {
+	for _, m := range spec.Mounts {
+		if m.Target == "/build/conf/local.conf" {
+			return filepath.Dir(filepath.Dir(m.Source))
+		}
+	}
+	return workspace.Path("native", "build")
+}
+
+// volumeDir is where the named volumes are kept on the host
+func (n *nativeRuntime) volumeDir(name string) string {
+	return workspace.Path("native", "volumes", name)
+}
+
+// BuildImage has nothing to build, the host is the image
+func (n *nativeRuntime) BuildImage(dockerfile, tag string, buildArgs map[string]string, buildLog io.Writer) error {
+	msg := fmt.Sprintf("native runtime: using host bitbake %s instead of image %s", n.bitbake, tag)
+	if buildLog != nil {
+		fmt.Fprintln(buildLog, msg)
+	}
+	log.Println(msg)
+	return nil
+}
+
+// setup lays out the build directory for spec
+func (n *nativeRuntime) setup(spec *RunSpec) error {
+	var layers []string
+
+	dir := n.buildDir(spec)
+	if err := os.MkdirAll(filepath.Join(dir, "conf"), 0777); err != nil {
+		return err
+	}
+	for _, m := range spec.Mounts {
+		src := m.Source
+		if m.Volume {
+			src = n.volumeDir(m.Source)
+			if err := os.MkdirAll(src, 0777); err != nil {
+				return err
+			}
+		}
+		if !strings.HasPrefix(m.Target, "/build/") {
+			// Everything mounted outside /build is a layer
+			layers = append(layers, src)
+			continue
+		}
+		link := filepath.Join(dir, strings.TrimPrefix(m.Target, "/build/"))
+		if link == src {
+			continue
+		}
+		if err := os.RemoveAll(link); err != nil {
+			return err
+		}
+		if err := os.Symlink(src, link); err != nil {
+			return err
+		}
+	}
+
+	bblayers := fmt.Sprintf("BBPATH = \"${TOPDIR}\"\nBBFILES ?= \"\"\nBBLAYERS ?= \"%s\"\n", strings.Join(layers, " "))
+	return ioutil.WriteFile(filepath.Join(dir, "conf", "bblayers.conf"), []byte(bblayers), 0644)
+}
+
+func (n *nativeRuntime) command(spec *RunSpec) (*exec.Cmd, error) {
+	if viper.GetBool("dryrun") {
+		fmt.Printf("cd %s && %s\n", n.buildDir(spec), strings.Join(spec.Cmd, " "))
+		return nil, nil
+	}
+	if err := n.setup(spec); err != nil {
+		return nil, fmt.Errorf("setting up native build directory: %v", err)
+	}
+	if spec.NoNetwork {
+		log.Printf("native runtime: network access can't be disabled, relying on BB_NO_NETWORK")
+	}
+	cmd := exec.Command(spec.Cmd[0], spec.Cmd[1:]...)
+	cmd.Dir = n.buildDir(spec)
+	cmd.Env = append(os.Environ(), spec.Env...)
+	return cmd, nil
+}
+
+func (n *nativeRuntime) Run(spec *RunSpec) (RunResult, error) {
+	var res RunResult
+
+	cmd, err := n.command(spec)
+	if cmd == nil {
+		return res, err
+	}
+	err = handleRunOutput(cmd, spec)
+	if cmd.Process != nil {
+		res.ContainerID = "pid " + strconv.Itoa(cmd.Process.Pid)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		res.ExitCode = exitErr.ExitCode()
+		return res, &ExitError{ContainerID: res.ContainerID, ExitCode: res.ExitCode}
+	}
+	return res, err
+}
+
+func (n *nativeRuntime) Shell(spec *RunSpec) error {
+	cmd, err := n.command(spec)
+	if cmd == nil {
+		return err
+	}
+	err = runInteractive(cmd)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return &ExitError{ContainerID: "pid " + strconv.Itoa(cmd.Process.Pid), ExitCode: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// RemoveContainers has nothing to do, no processes outlive tcb
+func (n *nativeRuntime) RemoveContainers() ([]string, error) {
+	return nil, nil
+}
+
+func (n *nativeRuntime) ListVolumes(prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(workspace.Path("native", "volumes"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), prefix) {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+func (n *nativeRuntime) RemoveVolumes(names ...string) error {
+	for _, name := range names {
+		if err := os.RemoveAll(n.volumeDir(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveImage has nothing to do, there is no image
+func (n *nativeRuntime) RemoveImage(name string) error {
+	return nil
+}
+
+// ImageID returns "", there is no image
+func (n *nativeRuntime) ImageID(name string) (string, error) {
+	return "", nil
+}
+
+// ImageLabels returns no labels, there is no image
+func (n *nativeRuntime) ImageLabels(name string) (map[string]string, error) {
+	return nil, nil
+}
+
+// SaveImage fails, there is no image
+func (n *nativeRuntime) SaveImage(name string, w io.Writer) error {
+	return fmt.Errorf("the native runtime has no images")
+}
+
+// LoadImage fails, there is no image
+func (n *nativeRuntime) LoadImage(r io.Reader) error {
+	return fmt.Errorf("the native runtime has no images")
+}
+
+// ListImages returns nothing, there are no images
+func (n *nativeRuntime) ListImages(repository string) ([]Image, error) {
+	return nil, nil
+}
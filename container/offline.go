@@ -0,0 +1,112 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package container
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// OfflineError is returned by --offline runs when inputs that would have
+// to be fetched are missing
+type OfflineError struct {
+	// Missing lists the inputs, like "image meta_crosstools_bitbake:..."
+	// or "source https://..."
+	Missing []string
+}
+
+func (e *OfflineError) Error() string {
+	return "missing for an offline build:\n  " + strings.Join(e.Missing, "\n  ")
+}
+
+// Offline returns true if tcb must not access the network
+func Offline() bool {
+	return viper.GetBool("offline")
+}
+
+// HasImage returns true if the builder image tag exists. The native
+// runtime always has it, it uses the host. An error means the runtime
+// failed, not that the image is missing.
+func HasImage(tag string) (bool, error) {
+	rt, err := Get()
+	if err != nil {
+		return false, err
+	}
+	if _, native := rt.(*nativeRuntime); native {
+		return true, nil
+	}
+	return imageExists(rt, tag)
+}
+
+// The bitbake messages naming a URL it failed to fetch
+var fetchFailureRes = []*regexp.Regexp{
+	regexp.MustCompile(`Fetcher failure for URL: '([^']+)'`),
+	regexp.MustCompile(`\(for url ([^)\s]+)\)`),
+}
+
+// fetchFailures collects the URLs of the fetch failures in the lines
+// written to it
+type fetchFailures struct {
+	mu   sync.Mutex
+	urls map[string]bool
+}
+
+func (f *fetchFailures) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, re := range fetchFailureRes {
+		for _, m := range re.FindAllSubmatch(p, -1) {
+			if f.urls == nil {
+				f.urls = map[string]bool{}
+			}
+			f.urls[string(m[1])] = true
+		}
+	}
+	return len(p), nil
+}
+
+// OfflineCheckLog is the name the logs of the MissingSources checks are
+// kept under, so they don't rotate the build logs of the targets out
+const OfflineCheckLog = "offline-check"
+
+// MissingSources runs the fetchall task of the build of job, which without
+// network access only succeeds when the sources are in the downloads
+// volume. It returns the sources that are not, as "source <url>".
+func MissingSources(job *Job) ([]string, error) {
+	var failures fetchFailures
+	args := []string{"bitbake", "-k", "-c", "fetchall", "image"}
+	_, err := execute(job, OfflineCheckLog, job.Target+": "+strings.Join(args, " "), &failures, args...)
+	var exitErr *ExitError
+	if err != nil && (!errors.As(err, &exitErr) || len(failures.urls) == 0) {
+		return nil, err
+	}
+	var missing []string
+	for url := range failures.urls {
+		missing = append(missing, "source "+url)
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
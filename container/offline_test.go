@@ -0,0 +1,48 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package container
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/staffano/tcb/workspace"
+)
+
+func TestMissingSourcesLog(t *testing.T) {
+	testBitbake(t)
+	fake.output = "ERROR: Fetcher failure for URL: 'https://example.com/gcc.tar.xz'\n"
+
+	missing, err := MissingSources(&Job{Target: "native-mingw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"source https://example.com/gcc.tar.xz"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("missing %v, want %v", missing, want)
+	}
+	// The check must not rotate the build logs of the target out
+	if runs, err := workspace.Logs("native-mingw"); err != nil || len(runs) != 0 {
+		t.Errorf("target logs %v, %v, want none", runs, err)
+	}
+	if runs, err := workspace.Logs(OfflineCheckLog); err != nil || len(runs) != 1 {
+		t.Errorf("%s logs %v, %v, want one", OfflineCheckLog, runs, err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// lineWriter prints everything written to it line by line, prefixed with a
+// timestamp and the kind of output. The lines are also written to log, if
+// it is not nil.
+type lineWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+}
+
+func newLineWriter(kind, prefix string, log io.Writer) *lineWriter {
+	pr, pw := io.Pipe()
+	w := &lineWriter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			line := fmt.Sprintf("[%s] %s %s| %s\n", time.Now().Format(time.StampMilli), kind, prefix, scanner.Text())
+			os.Stdout.WriteString(line)
+			if log != nil {
+				io.WriteString(log, line)
+			}
+		}
+		io.Copy(ioutil.Discard, pr)
+	}()
+	return w
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close flushes any pending output
+func (w *lineWriter) Close() error {
+	w.pw.Close()
+	<-w.done
+	return nil
+}
+
+// handleCmdOutput runs cmd with its output printed through line writers
+func handleCmdOutput(cmd *exec.Cmd, prefix string, log io.Writer) error {
+	stdout := newLineWriter("OUT", prefix, log)
+	stderr := newLineWriter("ERR", prefix, log)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	stdout.Close()
+	stderr.Close()
+	return err
+}
+
+// handleRunOutput runs the command of spec like handleCmdOutput, except
+// that the standard output goes to spec.Stdout if it is set
+func handleRunOutput(cmd *exec.Cmd, spec *RunSpec) error {
+	if spec.Stdout == nil {
+		return handleCmdOutput(cmd, spec.Prefix, spec.Log)
+	}
+	stderr := newLineWriter("ERR", spec.Prefix, spec.Log)
+	cmd.Stdout = spec.Stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	stderr.Close()
+	return err
+}
+
+// runInteractive runs cmd connected to the terminal
+func runInteractive(cmd *exec.Cmd) error {
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
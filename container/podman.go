@@ -0,0 +1,298 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package container
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	register("podman", newPodmanRuntime)
+}
+
+// podmanRuntime drives the podman command line tool, which works for
+// rootless setups where no daemon socket is available.
+type podmanRuntime struct {
+	bin string
+}
+
+func newPodmanRuntime() (Runtime, error) {
+	bin, err := exec.LookPath("podman")
+	if err != nil {
+		return nil, fmt.Errorf("podman runtime selected, but podman is not installed: %v", err)
+	}
+	return &podmanRuntime{bin: bin}, nil
+}
+
+func (p *podmanRuntime) Name() string {
+	return "podman"
+}
+
+// runArgs translates spec to the arguments of podman run
+func (p *podmanRuntime) runArgs(spec *RunSpec, name string, interactive bool) []string {
+	args := []string{"run", "--rm", "--name", name, "--label", containerLabel + "=true"}
+	if interactive {
+		args = append(args, "-i")
+	}
+	for _, e := range spec.Env {
+		args = append(args, "--env", e)
+	}
+	if spec.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(spec.CPUs, 'f', -1, 64))
+	}
+	if spec.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatInt(spec.Memory, 10))
+	}
+	if spec.NoNetwork {
+		args = append(args, "--network", "none")
+	}
+	for _, m := range spec.Mounts {
+		t := "bind"
+		if m.Volume {
+			t = "volume"
+		}
+		opt := fmt.Sprintf("type=%s,source=%s,target=%s", t, m.Source, m.Target)
+		if m.ReadOnly {
+			opt += ",readonly"
+		}
+		args = append(args, "--mount", opt)
+	}
+	args = append(args, spec.Image)
+	return append(args, spec.Cmd...)
+}
+
+func (p *podmanRuntime) command(args ...string) *exec.Cmd {
+	if viper.GetBool("dryrun") {
+		fmt.Printf("podman %s\n", strings.Join(args, " "))
+		return nil
+	}
+	return exec.Command(p.bin, args...)
+}
+
+func (p *podmanRuntime) BuildImage(dockerfile, tag string, buildArgs map[string]string, buildLog io.Writer) error {
+	dir, err := ioutil.TempDir("", "tcb-build")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "Dockerfile")
+	if err = ioutil.WriteFile(file, []byte(dockerfile), 0644); err != nil {
+		return err
+	}
+
+	args := []string{"build", "-t", tag, "-f", file}
+	for k, v := range buildArgs {
+		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", k, v))
+	}
+	args = append(args, dir)
+	cmd := p.command(args...)
+	if cmd == nil {
+		return nil
+	}
+	if err = handleCmdOutput(cmd, "podman build", buildLog); err != nil {
+		return fmt.Errorf("podman build: %v", err)
+	}
+	return nil
+}
+
+func (p *podmanRuntime) Run(spec *RunSpec) (RunResult, error) {
+	res := RunResult{ContainerID: containerName()}
+	cmd := p.command(p.runArgs(spec, res.ContainerID, false)...)
+	if cmd == nil {
+		return res, nil
+	}
+	err := handleRunOutput(cmd, spec)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		res.ExitCode = exitErr.ExitCode()
+		return res, &ExitError{ContainerID: res.ContainerID, ExitCode: res.ExitCode}
+	}
+	return res, err
+}
+
+func (p *podmanRuntime) Shell(spec *RunSpec) error {
+	name := containerName()
+	cmd := p.command(p.runArgs(spec, name, true)...)
+	if cmd == nil {
+		return nil
+	}
+	err := runInteractive(cmd)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return &ExitError{ContainerID: name, ExitCode: exitErr.ExitCode()}
+	}
+	return err
+}
+
+func (p *podmanRuntime) RemoveContainers() ([]string, error) {
+	out, err := exec.Command(p.bin, "ps", "-a", "-q", "--filter", "label="+containerLabel).Output()
+	if err != nil {
+		return nil, fmt.Errorf("podman ps: %v", err)
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if err = handleCmdOutput(exec.Command(p.bin, append([]string{"rm", "-f"}, ids...)...), "podman rm", nil); err != nil {
+		return nil, fmt.Errorf("podman rm: %v", err)
+	}
+	return ids, nil
+}
+
+func (p *podmanRuntime) ListVolumes(prefix string) ([]string, error) {
+	out, err := exec.Command(p.bin, "volume", "ls", "-q").Output()
+	if err != nil {
+		return nil, fmt.Errorf("podman volume ls: %v", err)
+	}
+	var names []string
+	for _, n := range strings.Fields(string(out)) {
+		if strings.HasPrefix(n, prefix) {
+			names = append(names, n)
+		}
+	}
+	return names, nil
+}
+
+func (p *podmanRuntime) RemoveVolumes(names ...string) error {
+	for _, n := range names {
+		// podman volume rm fails for missing volumes, so check first
+		if exec.Command(p.bin, "volume", "exists", n).Run() != nil {
+			continue
+		}
+		if err := handleCmdOutput(exec.Command(p.bin, "volume", "rm", "-f", n), "podman volume rm", nil); err != nil {
+			return fmt.Errorf("podman volume rm %s: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// imageExists runs podman image exists, which exits with 1 if the image
+// doesn't exist
+func (p *podmanRuntime) imageExists(name string) (bool, error) {
+	err := exec.Command(p.bin, "image", "exists", name).Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("podman image exists %s: %v", name, err)
+	}
+	return true, nil
+}
+
+func (p *podmanRuntime) RemoveImage(name string) error {
+	if exists, err := p.imageExists(name); err != nil || !exists {
+		return err
+	}
+	if err := handleCmdOutput(exec.Command(p.bin, "image", "rm", "-f", name), "podman image rm", nil); err != nil {
+		return fmt.Errorf("podman image rm %s: %v", name, err)
+	}
+	return nil
+}
+
+func (p *podmanRuntime) ImageID(name string) (string, error) {
+	if exists, err := p.imageExists(name); err != nil {
+		return "", err
+	} else if !exists {
+		return "", &NoImageError{Name: name}
+	}
+	out, err := exec.Command(p.bin, "image", "inspect", "--format", "{{.Id}}", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("podman image inspect %s: %v", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (p *podmanRuntime) ImageLabels(name string) (map[string]string, error) {
+	out, err := exec.Command(p.bin, "image", "inspect", "--format", "{{json .Labels}}", name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("podman image inspect %s: %v", name, err)
+	}
+	var labels map[string]string
+	if err = json.Unmarshal(out, &labels); err != nil {
+		return nil, fmt.Errorf("podman image inspect %s: %v", name, err)
+	}
+	return labels, nil
+}
+
+func (p *podmanRuntime) SaveImage(name string, w io.Writer) error {
+	cmd := exec.Command(p.bin, "save", "--format", "docker-archive", name)
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = w, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("podman save %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (p *podmanRuntime) LoadImage(r io.Reader) error {
+	cmd := exec.Command(p.bin, "load", "-q")
+	cmd.Stdin = r
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("podman load: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (p *podmanRuntime) ListImages(repository string) ([]Image, error) {
+	out, err := exec.Command(p.bin, "images", "--format", "json", "--filter", "reference="+repository).Output()
+	if err != nil {
+		return nil, fmt.Errorf("podman images: %v", err)
+	}
+	var summaries []struct {
+		ID      string   `json:"Id"`
+		Names   []string `json:"Names"`
+		Created int64    `json:"Created"`
+		Size    int64    `json:"Size"`
+	}
+	if err = json.Unmarshal(out, &summaries); err != nil {
+		return nil, fmt.Errorf("podman images: %v", err)
+	}
+	var images []Image
+	for _, s := range summaries {
+		for _, name := range s.Names {
+			// Podman qualifies local images with localhost/
+			tag := strings.TrimPrefix(name, "localhost/")
+			if strings.HasPrefix(tag, repository+":") {
+				images = append(images, Image{ID: s.ID, Tag: tag, Created: time.Unix(s.Created, 0), Size: s.Size})
+			}
+		}
+	}
+	return images, nil
+}
+
+// containerName returns a unique name for a container, since the podman
+// command line doesn't give us the id of a container run with --rm
+func containerName() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "tcb-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,342 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package container runs the bitbake builds in a container runtime. The
+// runtime used is selected with the "runtime" config key.
+package container
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/staffano/tcb/utils"
+	"github.com/staffano/tcb/workspace"
+)
+
+func init() {
+	viper.SetDefault("runtime", "docker")
+	viper.SetDefault("logs.keep", 10)
+}
+
+var downloadVol = "bb-downloads"
+
+// Each target has its own tmp volume, named by this prefix and the target
+var tmpVolPrefix = "bb-tmp-"
+
+// All containers created by tcb carry this label, so we can find them again
+const containerLabel = "nu.diversum.tcb"
+
+var proxyVars = [...]string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy",
+	"FTP_PROXY", "ftp_proxy", "NO_PROXY", "no_proxy"}
+
+// Mount describes a named volume or a bind mount of a host path
+type Mount struct {
+	Volume   bool
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// RunSpec describes a command to run in a container
+type RunSpec struct {
+	Image  string
+	Cmd    []string
+	Env    []string
+	Mounts []Mount
+	// CPUs and Memory (in bytes) limit the container, unless they are 0
+	CPUs   float64
+	Memory int64
+	// NoNetwork runs the container without network access
+	NoNetwork bool
+	// Prefix is used to tag the output lines of the command
+	Prefix string
+	// Log receives the output lines as well, if it is not nil
+	Log io.Writer
+	// Stdout receives the standard output of the command instead of it
+	// being printed, if it is not nil
+	Stdout io.Writer
+}
+
+// RunResult is the outcome of running a command in a container
+type RunResult struct {
+	ContainerID string
+	ExitCode    int
+}
+
+// ExitError is returned when the command in the container exits with a
+// non-zero status.
+type ExitError struct {
+	ContainerID string
+	ExitCode    int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("container %s exited with status %d", e.ContainerID, e.ExitCode)
+}
+
+// NoImageError is returned when an image doesn't exist
+type NoImageError struct {
+	Name string
+}
+
+func (e *NoImageError) Error() string {
+	return fmt.Sprintf("no such image %s", e.Name)
+}
+
+// ImageError is returned when the builder image could not be built
+type ImageError struct {
+	Err error
+}
+
+func (e *ImageError) Error() string {
+	return fmt.Sprintf("building the builder image: %v", e.Err)
+}
+
+func (e *ImageError) Unwrap() error {
+	return e.Err
+}
+
+// Runtime is implemented by the container engines tcb can use
+type Runtime interface {
+	// Name returns the name the runtime is selected by
+	Name() string
+	// BuildImage builds dockerfile and tags the result with tag. The
+	// output of the build is also written to buildLog, unless it is nil.
+	BuildImage(dockerfile, tag string, buildArgs map[string]string, buildLog io.Writer) error
+	// Run executes spec in a new container and removes it afterwards
+	Run(spec *RunSpec) (RunResult, error)
+	// Shell runs spec interactively, connected to the terminal
+	Shell(spec *RunSpec) error
+	// RemoveContainers removes any container left behind by tcb
+	RemoveContainers() ([]string, error)
+	// ListVolumes lists the volumes whose names start with prefix
+	ListVolumes(prefix string) ([]string, error)
+	// RemoveVolumes removes the named volumes if they exist
+	RemoveVolumes(names ...string) error
+	// RemoveImage removes the image if it exists
+	RemoveImage(name string) error
+	// ListImages lists the tagged images of repository
+	ListImages(repository string) ([]Image, error)
+	// ImageID returns the id of the image, a NoImageError if it doesn't
+	// exist, or "" if the runtime has no images
+	ImageID(name string) (string, error)
+	// ImageLabels returns the labels of the image
+	ImageLabels(name string) (map[string]string, error)
+	// SaveImage writes the image to w, as a tar archive
+	SaveImage(name string, w io.Writer) error
+	// LoadImage loads an image saved by SaveImage
+	LoadImage(r io.Reader) error
+}
+
+var runtimes = map[string]func() (Runtime, error){}
+
+// register makes a runtime available under name
+func register(name string, factory func() (Runtime, error)) {
+	runtimes[name] = factory
+}
+
+// Get returns the runtime selected by configuration
+func Get() (Runtime, error) {
+	name := viper.GetString("runtime")
+	factory, ok := runtimes[name]
+	if !ok {
+		var known []string
+		for n := range runtimes {
+			known = append(known, n)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unknown container runtime %q, use one of %s", name, strings.Join(known, ", "))
+	}
+	return factory()
+}
+
+// getProxyArgs returns the proxy settings of the environment as KEY=value
+func getProxyArgs() []string {
+	var res []string
+
+	// Append environment proxy variables if they are needed
+	for _, s := range proxyVars {
+		if val := os.Getenv(s); val != "" {
+			res = append(res, fmt.Sprintf("%s=%s", s, val))
+		}
+	}
+	return res
+}
+
+// getBuildArgs returns the proxy settings as image build arguments
+func getBuildArgs() map[string]string {
+	res := map[string]string{}
+	for _, s := range getProxyArgs() {
+		kv := strings.SplitN(s, "=", 2)
+		res[kv[0]] = kv[1]
+	}
+	return res
+}
+
+// Job tells where a bitbake run for a target reads and writes its files.
+// The target has its own local.conf, bblayers.conf and tmp volume, while
+// the downloads volume and the layers are shared between all targets.
+type Job struct {
+	Target string
+	// Image is the tag of the builder image, see ImageTag
+	Image         string
+	ResultDir     string
+	Layers        []Mount
+	LocalConfPath string
+	BBLayersPath  string
+}
+
+// TmpVolume returns the name of the volume holding the TMPDIR of target
+func TmpVolume(target string) string {
+	name := []byte(target)
+	for i, c := range name {
+		// Volume names are restricted to [a-zA-Z0-9_.-]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-') {
+			name[i] = '_'
+		}
+	}
+	return tmpVolPrefix + string(name)
+}
+
+func getVolumeArgs(job *Job) []Mount {
+	mounts := []Mount{
+		{Volume: true, Source: downloadVol, Target: "/build/downloads"},
+		{Volume: true, Source: TmpVolume(job.Target), Target: "/build/tmp"},
+		{Source: job.ResultDir, Target: "/build/RESULT"},
+		{Source: job.LocalConfPath, Target: "/build/conf/local.conf", ReadOnly: true},
+		{Source: job.BBLayersPath, Target: "/build/conf/bblayers.conf", ReadOnly: true},
+	}
+	return append(mounts, job.Layers...)
+}
+
+// Limits returns the CPU and memory limits of the containers, from the
+// container.cpus and container.memory config keys. 0 means no limit.
+func Limits() (cpus float64, memory int64, err error) {
+	if cpus = viper.GetFloat64("container.cpus"); cpus < 0 {
+		return 0, 0, fmt.Errorf("invalid container cpu limit %v", cpus)
+	}
+	if s := viper.GetString("container.memory"); s != "" {
+		if memory, err = utils.ParseSize(s); err != nil {
+			return 0, 0, fmt.Errorf("invalid container memory limit: %w", err)
+		}
+	}
+	return cpus, memory, nil
+}
+
+func runSpec(rt Runtime, job *Job, cmd ...string) *RunSpec {
+	prefix := rt.Name() + " run " + job.Target
+	// The limits have been checked by the commands already
+	cpus, memory, _ := Limits()
+	return &RunSpec{
+		CPUs:      cpus,
+		Memory:    memory,
+		NoNetwork: viper.GetBool("offline"),
+		Image:     job.Image,
+		Cmd:       cmd,
+		Env:       getProxyArgs(),
+		Mounts:    getVolumeArgs(job),
+		Prefix:    prefix,
+	}
+}
+
+// Execute set up the container and executes it with a bash command. The
+// output is logged in the logs of the target of the job.
+func Execute(job *Job, arguments ...string) (RunResult, error) {
+	return execute(job, job.Target, strings.Join(arguments, " "), nil, arguments...)
+}
+
+// execute is Execute, with the run logged under logName with title, and
+// the output lines also written to out if it is not nil
+func execute(job *Job, logName, title string, out io.Writer, arguments ...string) (RunResult, error) {
+	rt, err := Get()
+	if err != nil {
+		return RunResult{}, err
+	}
+	spec := runSpec(rt, job, arguments...)
+	l, err := workspace.OpenLog(logName, title, viper.GetInt("logs.keep"))
+	if err != nil {
+		return RunResult{}, err
+	}
+	spec.Log = l
+	if out != nil {
+		spec.Log = io.MultiWriter(l, out)
+	}
+	res, err := rt.Run(spec)
+	if finishErr := l.Finish(err); err == nil {
+		err = finishErr
+	}
+	return res, err
+}
+
+// RunBash executes bash prompt in the container
+func RunBash(job *Job) error {
+	rt, err := Get()
+	if err != nil {
+		return err
+	}
+	return rt.Shell(runSpec(rt, job, "bash", "-i"))
+}
+
+// RemoveTarget removes the tmp volume of target
+func RemoveTarget(target string) error {
+	rt, err := Get()
+	if err != nil {
+		return err
+	}
+	return rt.RemoveVolumes(TmpVolume(target))
+}
+
+// Prune all tcb related containers, volumes and images
+func Prune() error {
+	rt, err := Get()
+	if err != nil {
+		return err
+	}
+	removed, err := rt.RemoveContainers()
+	if err != nil {
+		return err
+	}
+	for _, id := range removed {
+		log.Printf("Removed container %s", id)
+	}
+	// There is one tmp volume for each target that has been built
+	vols, err := rt.ListVolumes(tmpVolPrefix)
+	if err != nil {
+		return err
+	}
+	if err = rt.RemoveVolumes(append(vols, downloadVol)...); err != nil {
+		return err
+	}
+	images, err := rt.ListImages(imageName)
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		if err = rt.RemoveImage(img.Tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
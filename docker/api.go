@@ -0,0 +1,418 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Mount describes a volume or bind mount into a container
+type Mount struct {
+	Type     string `json:"Type"`
+	Source   string `json:"Source"`
+	Target   string `json:"Target"`
+	ReadOnly bool   `json:"ReadOnly,omitempty"`
+}
+
+// HostConfig holds the host dependent part of a container configuration
+type HostConfig struct {
+	Mounts     []Mount `json:"Mounts,omitempty"`
+	AutoRemove bool    `json:"AutoRemove,omitempty"`
+	// NanoCPUs limits the CPU of the container, in units of 1e-9 CPUs
+	NanoCPUs int64 `json:"NanoCpus,omitempty"`
+	// Memory limits the memory of the container, in bytes
+	Memory int64 `json:"Memory,omitempty"`
+	// NetworkMode is "none" for a container without network access
+	NetworkMode string `json:"NetworkMode,omitempty"`
+}
+
+// ContainerConfig is the body of a container create request
+type ContainerConfig struct {
+	Image        string            `json:"Image"`
+	Cmd          []string          `json:"Cmd,omitempty"`
+	Env          []string          `json:"Env,omitempty"`
+	Labels       map[string]string `json:"Labels,omitempty"`
+	WorkingDir   string            `json:"WorkingDir,omitempty"`
+	AttachStdin  bool              `json:"AttachStdin"`
+	AttachStdout bool              `json:"AttachStdout"`
+	AttachStderr bool              `json:"AttachStderr"`
+	OpenStdin    bool              `json:"OpenStdin"`
+	StdinOnce    bool              `json:"StdinOnce"`
+	Tty          bool              `json:"Tty"`
+	HostConfig   HostConfig        `json:"HostConfig"`
+}
+
+// ContainerState is the runtime state reported by InspectContainer
+type ContainerState struct {
+	Status   string `json:"Status"`
+	Running  bool   `json:"Running"`
+	ExitCode int    `json:"ExitCode"`
+	Error    string `json:"Error"`
+}
+
+// ContainerInfo is the result of InspectContainer
+type ContainerInfo struct {
+	ID     string          `json:"Id"`
+	Name   string          `json:"Name"`
+	Image  string          `json:"Image"`
+	State  ContainerState  `json:"State"`
+	Config ContainerConfig `json:"Config"`
+}
+
+// ImageInfo is the part of an image inspection tcb uses
+type ImageInfo struct {
+	ID      string `json:"Id"`
+	Created string `json:"Created"`
+	Config  struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+// ImageSummary is one entry returned by ListImages
+type ImageSummary struct {
+	ID       string   `json:"Id"`
+	RepoTags []string `json:"RepoTags"`
+	Created  int64    `json:"Created"`
+	Size     int64    `json:"Size"`
+}
+
+// ContainerSummary is one entry returned by ListContainers
+type ContainerSummary struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Image  string            `json:"Image"`
+	State  string            `json:"State"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// BuildResult is the outcome of a successful image build
+type BuildResult struct {
+	ImageID string
+	Tag     string
+}
+
+// VolumeRemoveResult tells what happened to a volume we asked to remove
+type VolumeRemoveResult struct {
+	Name    string
+	Removed bool
+}
+
+// buildMessage is one line of the JSON stream returned by /build
+type buildMessage struct {
+	Stream      string `json:"stream"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux struct {
+		ID string `json:"ID"`
+	} `json:"aux"`
+}
+
+// BuildImage builds an image from dockerfile and tags it with tag. Each line
+// of build output is passed to out.
+func (c *Client) BuildImage(dockerfile, tag string, buildArgs map[string]string, out func(string)) (BuildResult, error) {
+	res := BuildResult{Tag: tag}
+
+	// The build context is a tar archive holding only the Dockerfile
+	var buildCtx bytes.Buffer
+	tw := tar.NewWriter(&buildCtx)
+	if err := tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile))}); err != nil {
+		return res, err
+	}
+	if _, err := io.WriteString(tw, dockerfile); err != nil {
+		return res, err
+	}
+	if err := tw.Close(); err != nil {
+		return res, err
+	}
+
+	args, err := json.Marshal(buildArgs)
+	if err != nil {
+		return res, err
+	}
+	q := url.Values{}
+	q.Set("t", tag)
+	q.Set("rm", "1")
+	q.Set("forcerm", "1")
+	q.Set("buildargs", string(args))
+
+	resp, err := c.do("POST", "/build", q, &buildCtx, "application/x-tar")
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg buildMessage
+		if err = dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return res, err
+		}
+		if msg.Error != "" {
+			return res, fmt.Errorf("docker build: %s", msg.Error)
+		}
+		if msg.Aux.ID != "" {
+			res.ImageID = msg.Aux.ID
+		}
+		for _, l := range strings.Split(strings.TrimRight(msg.Stream, "\n"), "\n") {
+			if l != "" && out != nil {
+				out(l)
+			}
+		}
+	}
+	if res.ImageID == "" {
+		return res, fmt.Errorf("docker build of %s did not report an image id", tag)
+	}
+	return res, nil
+}
+
+// RemoveImage removes the image name
+func (c *Client) RemoveImage(name string, force bool) error {
+	q := url.Values{}
+	q.Set("force", strconv.FormatBool(force))
+	return c.doJSON("DELETE", "/images/"+name, q, nil, nil)
+}
+
+// SaveImage writes the image name to w, as a tar archive
+func (c *Client) SaveImage(name string, w io.Writer) error {
+	q := url.Values{}
+	q.Set("names", name)
+	resp, err := c.do("GET", "/images/get", q, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// LoadImage loads the images of a tar archive written by SaveImage
+func (c *Client) LoadImage(r io.Reader) error {
+	resp, err := c.do("POST", "/images/load", nil, r, "application/x-tar")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg buildMessage
+		if err = dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("docker load: %s", msg.Error)
+		}
+	}
+}
+
+// InspectImage returns information about the image name
+func (c *Client) InspectImage(name string) (ImageInfo, error) {
+	var info ImageInfo
+	err := c.doJSON("GET", "/images/"+name+"/json", nil, nil, &info)
+	return info, err
+}
+
+// ListImages lists the images matching reference, e.g. "repo" for all tags
+// of a repository
+func (c *Client) ListImages(reference string) ([]ImageSummary, error) {
+	var res []ImageSummary
+	filters, _ := json.Marshal(map[string][]string{"reference": {reference}})
+	q := url.Values{}
+	q.Set("filters", string(filters))
+	err := c.doJSON("GET", "/images/json", q, nil, &res)
+	return res, err
+}
+
+// CreateContainer creates a container and returns its id
+func (c *Client) CreateContainer(cfg *ContainerConfig) (string, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := c.doJSON("POST", "/containers/create", nil, cfg, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// StartContainer starts a created container
+func (c *Client) StartContainer(id string) error {
+	return c.doJSON("POST", "/containers/"+id+"/start", nil, nil, nil)
+}
+
+// StopContainer stops a running container, killing it after timeout seconds
+func (c *Client) StopContainer(id string, timeout int) error {
+	q := url.Values{}
+	q.Set("t", strconv.Itoa(timeout))
+	return c.doJSON("POST", "/containers/"+id+"/stop", q, nil, nil)
+}
+
+// WaitContainer blocks until the container stops and returns its exit code
+func (c *Client) WaitContainer(id string) (int, error) {
+	var res struct {
+		StatusCode int `json:"StatusCode"`
+		Error      *struct {
+			Message string `json:"Message"`
+		} `json:"Error"`
+	}
+	if err := c.doJSON("POST", "/containers/"+id+"/wait", nil, nil, &res); err != nil {
+		return -1, err
+	}
+	if res.Error != nil && res.Error.Message != "" {
+		return res.StatusCode, fmt.Errorf("waiting for container %s: %s", ShortID(id), res.Error.Message)
+	}
+	return res.StatusCode, nil
+}
+
+// RemoveContainer removes a container, and its anonymous volumes
+func (c *Client) RemoveContainer(id string, force bool) error {
+	q := url.Values{}
+	q.Set("v", "1")
+	q.Set("force", strconv.FormatBool(force))
+	return c.doJSON("DELETE", "/containers/"+id, q, nil, nil)
+}
+
+// InspectContainer returns low level information about a container
+func (c *Client) InspectContainer(id string) (ContainerInfo, error) {
+	var info ContainerInfo
+	err := c.doJSON("GET", "/containers/"+id+"/json", nil, nil, &info)
+	return info, err
+}
+
+// ListContainers lists all containers, running or not, carrying label
+func (c *Client) ListContainers(label string) ([]ContainerSummary, error) {
+	var res []ContainerSummary
+	filters, _ := json.Marshal(map[string][]string{"label": {label}})
+	q := url.Values{}
+	q.Set("all", "1")
+	q.Set("filters", string(filters))
+	err := c.doJSON("GET", "/containers/json", q, nil, &res)
+	return res, err
+}
+
+// ContainerLogs streams stdout and stderr of a container to the given
+// writers until the container stops.
+func (c *Client) ContainerLogs(id string, stdout, stderr io.Writer) error {
+	q := url.Values{}
+	q.Set("follow", "1")
+	q.Set("stdout", "1")
+	q.Set("stderr", "1")
+	resp, err := c.do("GET", "/containers/"+id+"/logs", q, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return Demux(resp.Body, stdout, stderr)
+}
+
+// AttachContainer attaches to stdin, stdout and stderr of a container that
+// has not been started yet. Output is returned multiplexed, see Demux.
+func (c *Client) AttachContainer(id string) (net.Conn, *bufio.Reader, error) {
+	q := url.Values{}
+	q.Set("stream", "1")
+	q.Set("stdin", "1")
+	q.Set("stdout", "1")
+	q.Set("stderr", "1")
+	return c.hijack("POST", "/containers/"+id+"/attach", q)
+}
+
+// ListVolumes returns the names of the volumes starting with prefix
+func (c *Client) ListVolumes(prefix string) ([]string, error) {
+	var res struct {
+		Volumes []struct {
+			Name string `json:"Name"`
+		} `json:"Volumes"`
+	}
+	filters, _ := json.Marshal(map[string][]string{"name": {prefix}})
+	q := url.Values{}
+	q.Set("filters", string(filters))
+	if err := c.doJSON("GET", "/volumes", q, nil, &res); err != nil {
+		return nil, err
+	}
+	// The name filter matches anywhere in the name
+	var names []string
+	for _, v := range res.Volumes {
+		if strings.HasPrefix(v.Name, prefix) {
+			names = append(names, v.Name)
+		}
+	}
+	return names, nil
+}
+
+// RemoveVolume removes a named volume. Removing a volume that does not
+// exist is not an error, but is reported in the result.
+func (c *Client) RemoveVolume(name string, force bool) (VolumeRemoveResult, error) {
+	res := VolumeRemoveResult{Name: name}
+	q := url.Values{}
+	q.Set("force", strconv.FormatBool(force))
+	err := c.doJSON("DELETE", "/volumes/"+name, q, nil, nil)
+	if IsNotFound(err) {
+		return res, nil
+	}
+	res.Removed = err == nil
+	return res, err
+}
+
+// Demux splits the multiplexed stream used by the engine for containers
+// without a tty. Each frame has an 8 byte header where the first byte tells
+// the stream and the last four the size of the payload.
+func Demux(r io.Reader, stdout, stderr io.Writer) error {
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		w := stdout
+		if hdr[0] == 2 {
+			w = stderr
+		}
+		if _, err := io.CopyN(w, r, int64(binary.BigEndian.Uint32(hdr[4:]))); err != nil {
+			return err
+		}
+	}
+}
+
+// ShortID returns an image or container id the way docker prints it, the
+// first 12 digits without the sha256: prefix
+func ShortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -22,174 +22,180 @@ package docker
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"strings"
-	"time"
-
-	"github.com/spf13/viper"
 )
 
-var downloadVol = "bb-downloads"
-var tmpVol = "bb-tmp-vol"
-
-var proxyVars = [...]string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy",
-	"FTP_PROXY", "ftp_proxy", "NO_PROXY", "no_proxy"}
-
-var dockerFile = `FROM ubuntu
-RUN apt update -y && apt upgrade -y
-RUN apt install -y build-essential gnat-5 git locales python3 wget m4 gawk unzip nano texinfo
-RUN locale-gen en_US.UTF-8
-RUN git clone https://github.com/openembedded/bitbake.git && cd /bitbake
-ENV LANG en_US.UTF-8
-ENV PATH /bitbake/bin:$PATH
-ENV PYTHONPATH /bitbake/lib:$PYTHONPATH
-RUN mkdir -p /build/conf
-VOLUME /meta-crosstools
-VOLUME /build/tmp
-RUN printf "BBPATH = \"${TOPDIR}\"\nBBFILES ?= \"\"\nBBLAYERS ?= \"/meta-crosstools\"\n" >> /build/conf/bblayers.conf
-WORKDIR /build
-CMD ["bitbake", "--help"]
-#ENTRYPOINT [ "/build.sh"]
-`
-
-func getProxyArgs(argName string) []string {
-	var res []string
-
-	// Append environment proxy variables if they are needed
-	for _, s := range proxyVars {
-		if val := os.Getenv(s); val != "" {
-			res = append(res, argName, fmt.Sprintf("%s=%s", s, val))
-		}
-	}
-	return res
-}
-
-func getVolumeArgs(resultDir, metaCrosstoolsDir, localConfPath string) []string {
-	var res []string
+// The API version we speak. Anything newer than this will accept our
+// requests as well.
+const apiVersion = "v1.41"
 
-	res = append(res, "-v", fmt.Sprintf("%s:/build/downloads", downloadVol))
-	res = append(res, "-v", fmt.Sprintf("%s:/build/tmp", tmpVol))
-	res = append(res, "-v", fmt.Sprintf("%s:/build/RESULT", resultDir))
-	res = append(res, "-v", fmt.Sprintf("%s:/meta-crosstools/", metaCrosstoolsDir))
-	res = append(res, "--mount", fmt.Sprintf("type=bind,source=%s,target=/build/conf/local.conf,readonly", localConfPath))
+const defaultSocket = "/var/run/docker.sock"
 
-	return res
+// Client talks to a Docker Engine over its HTTP API.
+type Client struct {
+	network string
+	address string
+	http    *http.Client
 }
 
-// BuildImage creates the image we will base our container on
-func BuildImage() {
+// APIError is returned when the engine responds with a non 2xx status
+type APIError struct {
+	StatusCode int
+	Message    string
+}
 
-	args := []string{"build"}
-	args = append(args, getProxyArgs("--build-arg")...)
-	args = append(args, "-t", "meta_crosstools_bitbake", "-")
+func (e *APIError) Error() string {
+	return fmt.Sprintf("docker engine: %s (status %d)", e.Message, e.StatusCode)
+}
 
-	cmd := exec.Command("docker", args...)
+// IsNotFound returns true if err is an APIError telling that the object
+// did not exist.
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
 
-	// Connect dockerFile to stdin
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Fatal(err)
+// NewClient creates a client for the engine listening on host. The host is
+// given in the same format as DOCKER_HOST, e.g. unix:///var/run/docker.sock
+// or tcp://localhost:2375. A bare path is treated as a unix socket.
+func NewClient(host string) (*Client, error) {
+	c := &Client{}
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		c.network, c.address = "unix", strings.TrimPrefix(host, "unix://")
+	case strings.HasPrefix(host, "tcp://"):
+		c.network, c.address = "tcp", strings.TrimPrefix(host, "tcp://")
+	case strings.HasPrefix(host, "/"):
+		c.network, c.address = "unix", host
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q", host)
 	}
-
-	go func() {
-		defer stdin.Close()
-		io.WriteString(stdin, dockerFile)
-	}()
-
-	handleCmdOutput(cmd, "docker build")
+	c.http = &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return c.dial()
+			},
+		},
+	}
+	return c, nil
 }
 
-// Prune all tcb related docker stuff
-func Prune() {
-	cmd := exec.Command("docker", "volume", "rm", "-f", tmpVol)
-	handleCmdOutput(cmd, "docker volume rm")
-
-	cmd = exec.Command("docker", "volume", "rm", "-f", downloadVol)
-	handleCmdOutput(cmd, "docker volume rm")
-
-	cmd = exec.Command("docker", "image", "rm", "-f", "meta_crosstools_bitbake")
-	handleCmdOutput(cmd, "docker image rm meta_crosstools_bitbake")
+// NewEnvClient creates a client from the DOCKER_HOST environment variable,
+// falling back to the default unix socket.
+func NewEnvClient() (*Client, error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = "unix://" + defaultSocket
+	}
+	return NewClient(host)
 }
 
-// Execute set up the container and executes it with a bash command
-func Execute(resultDir, metaCrosstoolsDir, localConfPath string, arguments ...string) {
-
-	args := []string{"run", "-i", "--rm"}
-	args = append(args, getProxyArgs("--env")...)
-	args = append(args, getVolumeArgs(resultDir, metaCrosstoolsDir, localConfPath)...)
-	args = append(args, "meta_crosstools_bitbake")
-	args = append(args, arguments...)
-
-	if viper.GetBool("dryrun") {
-		fmt.Printf("docker %s", strings.Trim(fmt.Sprintf("%v", args), "[]"))
-	} else {
-		cmd := exec.Command("docker", args...)
-		handleCmdOutput(cmd, "docker run")
-	}
+func (c *Client) dial() (net.Conn, error) {
+	return net.Dial(c.network, c.address)
 }
 
-// RunBash executes bash prompt in the container
-func RunBash(resultDir, metaCrosstoolsDir, localConfPath string) {
-
-	args := []string{"run", "-i", "--rm"}
-	args = append(args, getProxyArgs("--env")...)
-	args = append(args, getVolumeArgs(resultDir, metaCrosstoolsDir, localConfPath)...)
-	args = append(args, "meta_crosstools_bitbake")
-	args = append(args, "bash")
-	args = append(args, "-i")
-
-	if viper.GetBool("dryrun") {
-		fmt.Printf("docker %s", strings.Trim(fmt.Sprintf("%v", args), "[]"))
-	} else {
-		cmd := exec.Command("docker", args...)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Run()
-		fmt.Println("Done.")
+func (c *Client) newRequest(method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := "http://docker/" + apiVersion + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
 	}
+	return http.NewRequest(method, u, body)
 }
 
-func handleCmdOutput(cmd *exec.Cmd, prefix string) error {
-
-	cmdErrReader, err := cmd.StderrPipe()
+// do sends a request to the engine and returns the response if the status
+// code signals success. The caller is responsible for closing the body.
+func (c *Client) do(method, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := c.newRequest(method, path, query, body)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error creating StderrPipe for Cmd", err)
-		os.Exit(1)
+		return nil, err
 	}
-
-	errScanner := bufio.NewScanner(cmdErrReader)
-	go func() {
-		for errScanner.Scan() {
-			fmt.Printf("[%s] ERR %s| %s\n", time.Now().Format(time.StampMilli), prefix, errScanner.Text())
-		}
-	}()
-
-	cmdStdOutReader, err := cmd.StdoutPipe()
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error creating StdoutPipe for Cmd", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("docker engine unreachable at %s: %v", c.address, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
 	}
+	return resp, nil
+}
 
-	stdOutScanner := bufio.NewScanner(cmdStdOutReader)
-	go func() {
-		for stdOutScanner.Scan() {
-			fmt.Printf("[%s] OUT %s| %s\n", time.Now().Format(time.StampMilli), prefix, stdOutScanner.Text())
+// doJSON sends in as a JSON body and decodes the response into out. Both
+// in and out may be nil.
+func (c *Client) doJSON(method, path string, query url.Values, in, out interface{}) error {
+	var (
+		body        io.Reader
+		contentType string
+	)
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
 		}
-	}()
-
-	err = cmd.Start()
+		body, contentType = bytes.NewReader(b), "application/json"
+	}
+	resp, err := c.do(method, path, query, body, contentType)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
 
-	err = cmd.Wait()
+// hijack sends a request and takes over the underlying connection, as
+// needed by the attach endpoint to stream stdin.
+func (c *Client) hijack(method, path string, query url.Values) (net.Conn, *bufio.Reader, error) {
+	req, err := c.newRequest(method, path, query, nil)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("docker engine unreachable at %s: %v", c.address, err)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, nil, decodeError(resp)
+	}
+	return conn, br, nil
+}
+
+func decodeError(resp *http.Response) error {
+	var msg struct {
+		Message string `json:"message"`
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(b, &msg); err != nil || msg.Message == "" {
+		msg.Message = strings.TrimSpace(string(b))
 	}
-	return nil
+	return &APIError{StatusCode: resp.StatusCode, Message: msg.Message}
 }
@@ -0,0 +1,266 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package docker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeEngine serves handler on a unix socket in a temporary directory, and
+// returns a client talking to it and a function stopping it
+func fakeEngine(t *testing.T, handler http.HandlerFunc) (*Client, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tcb-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener = l
+	srv.Start()
+	c, err := NewClient("unix://" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// route answers requests for method and path, the API version stripped,
+// with status and body
+func route(t *testing.T, method, path string, status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method || r.URL.Path != "/"+apiVersion+path {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}
+}
+
+func TestBuildImage(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		id    string
+		lines []string
+		err   string
+	}{
+		{
+			name: "success",
+			body: `{"stream":"Step 1/2 : FROM ubuntu\n"}
+{"stream":" ---> 1234\nStep 2/2 : RUN true\n"}
+{"aux":{"ID":"sha256:abcd"}}
+{"stream":"Successfully built abcd\n"}`,
+			id:    "sha256:abcd",
+			lines: []string{"Step 1/2 : FROM ubuntu", " ---> 1234", "Step 2/2 : RUN true", "Successfully built abcd"},
+		},
+		{
+			name: "error",
+			body: `{"stream":"Step 1/2 : FROM ubuntu\n"}
+{"error":"The command '/bin/sh -c false' returned a non-zero code: 1","errorDetail":{"message":"The command '/bin/sh -c false' returned a non-zero code: 1"}}`,
+			lines: []string{"Step 1/2 : FROM ubuntu"},
+			err:   "docker build: The command '/bin/sh -c false' returned a non-zero code: 1",
+		},
+		{
+			name:  "no image id",
+			body:  `{"stream":"Step 1/1 : FROM ubuntu\n"}`,
+			lines: []string{"Step 1/1 : FROM ubuntu"},
+			err:   "docker build of test:1 did not report an image id",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, stop := fakeEngine(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("t") != "test:1" || r.Header.Get("Content-Type") != "application/x-tar" {
+					t.Errorf("unexpected build request %s", r.URL)
+				}
+				route(t, "POST", "/build", 200, tt.body)(w, r)
+			})
+			defer stop()
+
+			var lines []string
+			res, err := c.BuildImage("FROM ubuntu\n", "test:1", nil, func(l string) { lines = append(lines, l) })
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("BuildImage error = %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Errorf("BuildImage: %v", err)
+			} else if res.ImageID != tt.id {
+				t.Errorf("BuildImage id = %q, want %q", res.ImageID, tt.id)
+			}
+			if strings.Join(lines, "\n") != strings.Join(tt.lines, "\n") {
+				t.Errorf("BuildImage output = %q, want %q", lines, tt.lines)
+			}
+		})
+	}
+}
+
+func TestCreateContainer(t *testing.T) {
+	c, stop := fakeEngine(t, route(t, "POST", "/containers/create", 201, `{"Id":"0123456789abcdef","Warnings":[]}`))
+	defer stop()
+	id, err := c.CreateContainer(&ContainerConfig{Image: "test"})
+	if err != nil || id != "0123456789abcdef" {
+		t.Errorf("CreateContainer = %q, %v", id, err)
+	}
+}
+
+func TestWaitContainer(t *testing.T) {
+	tests := []struct {
+		body string
+		code int
+		err  string
+	}{
+		{`{"StatusCode":0}`, 0, ""},
+		{`{"StatusCode":3}`, 3, ""},
+		{`{"StatusCode":137,"Error":{"Message":"killed"}}`, 137, "waiting for container 0123456789ab: killed"},
+	}
+	for _, tt := range tests {
+		c, stop := fakeEngine(t, route(t, "POST", "/containers/0123456789abcdef/wait", 200, tt.body))
+		code, err := c.WaitContainer("0123456789abcdef")
+		stop()
+		if code != tt.code {
+			t.Errorf("WaitContainer(%s) = %d, want %d", tt.body, code, tt.code)
+		}
+		if (err == nil) != (tt.err == "") || err != nil && err.Error() != tt.err {
+			t.Errorf("WaitContainer(%s) error = %v, want %q", tt.body, err, tt.err)
+		}
+	}
+}
+
+func TestWaitContainerNotFound(t *testing.T) {
+	c, stop := fakeEngine(t, route(t, "POST", "/containers/gone/wait", 404, `{"message":"No such container: gone"}`))
+	defer stop()
+	code, err := c.WaitContainer("gone")
+	if code != -1 || !IsNotFound(err) {
+		t.Errorf("WaitContainer = %d, %v, want -1 and a not found error", code, err)
+	}
+}
+
+func TestRemoveVolume(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		removed bool
+		err     bool
+	}{
+		{204, "", true, false},
+		{404, `{"message":"get bb-tmp-x: no such volume"}`, false, false},
+		{409, `{"message":"volume is in use"}`, false, true},
+	}
+	for _, tt := range tests {
+		c, stop := fakeEngine(t, route(t, "DELETE", "/volumes/bb-tmp-x", tt.status, tt.body))
+		res, err := c.RemoveVolume("bb-tmp-x", true)
+		stop()
+		if res.Name != "bb-tmp-x" || res.Removed != tt.removed || (err != nil) != tt.err {
+			t.Errorf("RemoveVolume with status %d = %+v, %v", tt.status, res, err)
+		}
+	}
+}
+
+// frame returns a frame of the multiplexed stream
+func frame(stream byte, payload string) []byte {
+	hdr := make([]byte, 8)
+	hdr[0] = stream
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(payload)))
+	return append(hdr, payload...)
+}
+
+func TestDemux(t *testing.T) {
+	var in bytes.Buffer
+	in.Write(frame(1, "out 1\n"))
+	in.Write(frame(2, "err 1\n"))
+	in.Write(frame(1, ""))
+	in.Write(frame(1, "out 2\n"))
+
+	var stdout, stderr bytes.Buffer
+	if err := Demux(&in, &stdout, &stderr); err != nil {
+		t.Fatalf("Demux: %v", err)
+	}
+	if stdout.String() != "out 1\nout 2\n" || stderr.String() != "err 1\n" {
+		t.Errorf("Demux = %q, %q", stdout.String(), stderr.String())
+	}
+
+	// A frame shorter than its header tells is an error
+	truncated := frame(1, "out 1\n")
+	if err := Demux(bytes.NewReader(truncated[:10]), &stdout, &stderr); err == nil {
+		t.Error("Demux of a truncated frame succeeded")
+	}
+	if err := Demux(bytes.NewReader(truncated[:4]), &stdout, &stderr); err == nil {
+		t.Error("Demux of a truncated header succeeded")
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		msg    string
+	}{
+		{404, `{"message":"No such image: test:1"}`, "No such image: test:1"},
+		{500, "page not found\n", "page not found"},
+		{500, `{"other":"field"}`, `{"other":"field"}`},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Body: ioutil.NopCloser(strings.NewReader(tt.body))}
+		err := decodeError(resp)
+		apiErr, ok := err.(*APIError)
+		if !ok || apiErr.StatusCode != tt.status || apiErr.Message != tt.msg {
+			t.Errorf("decodeError(%d, %q) = %#v", tt.status, tt.body, err)
+		}
+		if IsNotFound(err) != (tt.status == 404) {
+			t.Errorf("IsNotFound(%v) = %t", err, IsNotFound(err))
+		}
+	}
+}
+
+func TestShortID(t *testing.T) {
+	tests := map[string]string{
+		"sha256:0123456789abcdef0123": "0123456789ab",
+		"0123456789abcdef0123":        "0123456789ab",
+		"0123":                        "0123",
+	}
+	for id, want := range tests {
+		if got := ShortID(id); got != want {
+			t.Errorf("ShortID(%s) = %s, want %s", id, got, want)
+		}
+	}
+}
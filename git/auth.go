@@ -0,0 +1,194 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package git
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("git.ssh_agent", true)
+	viper.SetDefault("git.username", "x-access-token")
+	viper.SetDefault("git.netrc", "~/.netrc")
+	viper.BindEnv("git.ssh_key", "TCB_GIT_SSH_KEY")
+	viper.BindEnv("git.token", "TCB_GIT_TOKEN")
+}
+
+// authEnv returns the environment for running git against the repository
+// at rawURL with the configured credentials:
+//
+//   - git.ssh_key selects the SSH key to use
+//   - git.ssh_agent set to false keeps git from using the SSH agent
+//   - git.token is sent to HTTPS servers, as the password of
+//     git.username. If git.token_host is set, only to that host.
+//   - otherwise HTTPS credentials are looked up in the netrc file git.netrc
+//
+// The credentials are passed in the environment, never on the command
+// line, so they don't show up in logs or process lists.
+func authEnv(rawURL string) ([]string, error) {
+	env := os.Environ()
+	// Fail instead of hanging on a password prompt
+	env = append(env, "GIT_TERMINAL_PROMPT=0")
+
+	if !viper.GetBool("git.ssh_agent") {
+		env = unsetEnv(env, "SSH_AUTH_SOCK")
+	}
+	if key := viper.GetString("git.ssh_key"); key != "" {
+		key, err := homedir.Expand(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = os.Stat(key); err != nil {
+			return nil, fmt.Errorf("ssh key: %w", err)
+		}
+		env = append(unsetEnv(env, "GIT_SSH_COMMAND"),
+			"GIT_SSH_COMMAND=ssh -i '"+strings.Replace(key, "'", `'\''`, -1)+"' -o IdentitiesOnly=yes")
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return env, nil
+	}
+	user, password, err := httpCredentials(u.Hostname())
+	if err != nil || password == "" {
+		return env, err
+	}
+	if u.Scheme != "https" {
+		// Basic auth over plain http would send the password in clear text
+		log.Printf("Not using the stored credentials of %s for %s, it is not https", user, rawURL)
+		return env, nil
+	}
+	log.Printf("Using stored credentials of %s for %s", user, u.Host)
+	header := "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	return addConfig(env, "http."+u.Scheme+"://"+u.Host+"/.extraHeader", header), nil
+}
+
+// httpCredentials returns the user and password to use for host
+func httpCredentials(host string) (string, string, error) {
+	if token := viper.GetString("git.token"); token != "" {
+		if h := viper.GetString("git.token_host"); h == "" || h == host {
+			return viper.GetString("git.username"), token, nil
+		}
+	}
+	file, err := homedir.Expand(viper.GetString("git.netrc"))
+	if err != nil {
+		return "", "", err
+	}
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	user, password := netrcLookup(string(content), host)
+	return user, password, nil
+}
+
+// netrcLookup returns the login and password of host in a netrc file. The
+// default entry is used if host has none.
+func netrcLookup(content, host string) (string, string) {
+	type entry struct{ machine, login, password string }
+	var entries []*entry
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Split(bufio.ScanWords)
+	next := func() string {
+		if scanner.Scan() {
+			return scanner.Text()
+		}
+		return ""
+	}
+	for tok := next(); tok != ""; tok = next() {
+		switch tok {
+		case "machine":
+			entries = append(entries, &entry{machine: next()})
+		case "default":
+			entries = append(entries, &entry{})
+		case "login", "password":
+			val := next()
+			if len(entries) == 0 {
+				continue
+			}
+			if e := entries[len(entries)-1]; tok == "login" {
+				e.login = val
+			} else {
+				e.password = val
+			}
+		}
+	}
+	for _, e := range entries {
+		if e.machine == host {
+			return e.login, e.password
+		}
+	}
+	for _, e := range entries {
+		if e.machine == "" {
+			return e.login, e.password
+		}
+	}
+	return "", ""
+}
+
+// unsetEnv removes name from env
+func unsetEnv(env []string, name string) []string {
+	var res []string
+	for _, e := range env {
+		if !strings.HasPrefix(e, name+"=") {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// addConfig adds a git config setting through the environment, after the
+// ones that may already be set there
+func addConfig(env []string, key, value string) []string {
+	n := 0
+	for _, e := range env {
+		if strings.HasPrefix(e, "GIT_CONFIG_COUNT=") {
+			n, _ = strconv.Atoi(strings.TrimPrefix(e, "GIT_CONFIG_COUNT="))
+		}
+	}
+	env = unsetEnv(env, "GIT_CONFIG_COUNT")
+	return append(env,
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", n, key),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", n, value),
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", n+1))
+}
+
+var userinfoRe = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.\-]*://)[^/@\s]+@`)
+
+// Redact hides credentials embedded in the URLs in s
+func Redact(s string) string {
+	return userinfoRe.ReplaceAllString(s, "${1}***@")
+}
@@ -0,0 +1,114 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package git
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// setConfig sets a config key for the duration of the test
+func setConfig(t *testing.T, key string, value interface{}) {
+	t.Helper()
+	old := viper.Get(key)
+	viper.Set(key, value)
+	t.Cleanup(func() { viper.Set(key, old) })
+}
+
+// basicAuth returns the credentials of the Authorization header added to
+// env, as user:password, or "" if there is none
+func basicAuth(t *testing.T, env []string) string {
+	t.Helper()
+	const prefix = "Authorization: Basic "
+	for _, e := range env {
+		if i := strings.Index(e, prefix); i >= 0 && strings.HasPrefix(e, "GIT_CONFIG_VALUE_") {
+			b, err := base64.StdEncoding.DecodeString(e[i+len(prefix):])
+			if err != nil {
+				t.Fatalf("bad Authorization header %q: %v", e, err)
+			}
+			return string(b)
+		}
+	}
+	return ""
+}
+
+func TestAuthEnvCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcb-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const netrc = "machine example.com login bob password hunter2\n" +
+		"machine other.com\n  login alice\n  password s3cret\n"
+	const netrcDefault = netrc + "default login anon password guest\n"
+
+	tests := []struct {
+		name      string
+		token     string
+		tokenHost string
+		netrc     string
+		url       string
+		want      string
+	}{
+		{"token https", "tok", "", "", "https://example.com/repo.git", "x-access-token:tok"},
+		{"token http", "tok", "", "", "http://example.com/repo.git", ""},
+		{"token ssh", "tok", "", "", "ssh://git@example.com/repo.git", ""},
+		{"token scp", "tok", "", "", "git@example.com:repo.git", ""},
+		{"token host", "tok", "example.com", "", "https://example.com/repo.git", "x-access-token:tok"},
+		{"token other host", "tok", "example.com", "", "https://other.com/repo.git", ""},
+		{"token other host netrc", "tok", "example.com", netrc, "https://other.com/repo.git", "alice:s3cret"},
+		{"netrc", "", "", netrc, "https://example.com:8443/repo.git", "bob:hunter2"},
+		{"netrc http", "", "", netrc, "http://example.com/repo.git", ""},
+		{"netrc unknown host", "", "", netrc, "https://unknown.com/repo.git", ""},
+		{"netrc default", "", "", netrcDefault, "https://unknown.com/repo.git", "anon:guest"},
+		{"no netrc", "", "", "", "https://example.com/repo.git", ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "netrc-missing")
+			if tt.netrc != "" {
+				file = filepath.Join(dir, fmt.Sprintf("netrc%d", i))
+				if err := ioutil.WriteFile(file, []byte(tt.netrc), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setConfig(t, "git.token", tt.token)
+			setConfig(t, "git.token_host", tt.tokenHost)
+			setConfig(t, "git.netrc", file)
+
+			env, err := authEnv(tt.url)
+			if err != nil {
+				t.Fatalf("authEnv(%s): %v", tt.url, err)
+			}
+			if got := basicAuth(t, env); got != tt.want {
+				t.Errorf("authEnv(%s) sends %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package git
+
+import (
+	"os"
+
+	"github.com/staffano/tcb/utils"
+)
+
+// CreateBundle writes the branches, tags and remote-tracking branches of
+// the repository at dir, and its HEAD, to the bundle file
+func CreateBundle(dir, file string) error {
+	os.Remove(file)
+	_, err := run(dir, "bundle", "bundle", "create", "-q", file, "--all")
+	return err
+}
+
+// FetchBundle fetches the remote-tracking branches, the tags and the HEAD
+// of a bundle written by CreateBundle into the repository at dir, as if
+// they had been fetched from origin. When dir doesn't exist, a repository
+// is created with url as its origin. The bundle HEAD is left in FETCH_HEAD.
+func FetchBundle(dir, file, url string) error {
+	if !utils.PathExists(dir) {
+		if _, err := run("", "init", "init", "-q", dir); err != nil {
+			return err
+		}
+		if _, err := run(dir, "remote", "remote", "add", "origin", url); err != nil {
+			return err
+		}
+	}
+	_, err := run(dir, "fetch", "fetch", "-q", file,
+		"+refs/remotes/origin/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*", "HEAD")
+	return err
+}
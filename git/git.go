@@ -21,35 +21,301 @@
 package git
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/staffano/tcb/utils"
 )
 
-// Clone a repository to the current directory
-// example err := git.Clone("https://github.com/staffano/meta-crosstools", "meta-crosstools", "master")
-func Clone(srcPath string, dstPath string, rev string) error {
-	var (
-		err error
-	)
-	log.Printf("git clone -b %s --single-branch %s %s", rev, srcPath, dstPath)
-	if _, err = exec.Command("git", "clone", "-b", rev, "--single-branch",
-		srcPath, dstPath).Output(); err != nil {
-		log.Println("Error cloning: ", err)
-		return err
+// Error is returned when a git command fails
+type Error struct {
+	Op  string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("git %s: %v", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// DirtyError is returned instead of checking out a revision over local
+// modifications
+type DirtyError struct {
+	Dir    string
+	Reason string
+}
+
+func (e *DirtyError) Error() string {
+	return fmt.Sprintf("%s %s, refusing to overwrite them", e.Dir, e.Reason)
+}
+
+// Clone a repository to dstPath and check out rev, which may be a branch,
+// a tag or a commit. It returns the commit checked out.
+// example commit, err := git.Clone("https://github.com/staffano/meta-crosstools", "meta-crosstools", "master")
+func Clone(srcPath string, dstPath string, rev string) (string, error) {
+	env, err := authEnv(srcPath)
+	if err != nil {
+		return "", &Error{"clone", err}
+	}
+	if _, err = runEnv("", env, "clone", "clone", "--no-checkout", srcPath, dstPath); err != nil {
+		return "", err
+	}
+	// The index of a --no-checkout clone lists every file as deleted, so
+	// it is checked out without looking for local modifications. A clone
+	// that can't be checked out is removed, so the next run clones again.
+	err = Fetch(dstPath, rev)
+	var commit string
+	if err == nil {
+		commit, err = checkout(dstPath, rev)
+	}
+	if err != nil {
+		os.RemoveAll(dstPath)
+		return "", err
+	}
+	return commit, nil
+}
+
+// Update fetches from origin and checks out rev in the repository at dir,
+// see Checkout. It returns the commit checked out.
+func Update(dir, rev string) (string, error) {
+	if dirty, err := IsDirty(dir); err != nil {
+		return "", err
+	} else if dirty {
+		return "", &Error{"checkout", &DirtyError{dir, "has local modifications"}}
+	}
+	if err := Fetch(dir, rev); err != nil {
+		return "", err
+	}
+	return checkout(dir, rev)
+}
+
+// Checkout checks out rev in the repository at dir, without fetching. A
+// branch is checked out as a local branch following origin, a tag or a
+// commit is checked out detached. It refuses to if that would lose local
+// modifications or commits, and returns the commit checked out.
+func Checkout(dir, rev string) (string, error) {
+	if dirty, err := IsDirty(dir); err != nil {
+		return "", err
+	} else if dirty {
+		return "", &Error{"checkout", &DirtyError{dir, "has local modifications"}}
+	}
+	return checkout(dir, rev)
+}
+
+// checkout is Checkout without the check for local modifications
+func checkout(dir, rev string) (string, error) {
+	if remote, ok := verify(dir, "refs/remotes/origin/"+rev); ok {
+		// A branch. Moving the local branch must not drop commits that
+		// are not on origin.
+		if local, ok := verify(dir, "refs/heads/"+rev); ok && !isAncestor(dir, local, remote) {
+			return "", &Error{"checkout", &DirtyError{dir, "has commits on " + rev + " that are not on origin"}}
+		}
+		if _, err := run(dir, "checkout", "checkout", "-q", "-B", rev, "refs/remotes/origin/"+rev); err != nil {
+			return "", err
+		}
+	} else {
+		commit, err := Resolve(dir, rev)
+		if err != nil {
+			return "", err
+		}
+		if _, err = run(dir, "checkout", "checkout", "-q", "--detach", commit); err != nil {
+			return "", err
+		}
+	}
+
+	commit, err := Head(dir)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("%s: %s resolved to %s", dir, rev, commit)
+	return commit, nil
+}
+
+// Head returns the commit checked out in the repository at dir. It doesn't
+// depend on the current workdir, so it is safe to use from concurrent
+// builds.
+func Head(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		err = withStderr(err)
+		log.Printf("Error resolving HEAD: %v", err)
+		return "", &Error{"rev-parse", err}
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// run runs git with args in the repository at dir
+func run(dir, op string, args ...string) (string, error) {
+	return runEnv(dir, nil, op, args...)
+}
+
+// runEnv runs git with args in the repository at dir. If env is not nil it
+// is the environment of git, as returned by authEnv.
+func runEnv(dir string, env []string, op string, args ...string) (string, error) {
+	if dir != "" {
+		log.Printf("git %s (in %s)", Redact(strings.Join(args, " ")), dir)
+	} else {
+		log.Printf("git %s", Redact(strings.Join(args, " ")))
 	}
-	return nil
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		err = withStderr(err)
+		log.Printf("Error running git %s: %v", op, err)
+		return "", &Error{op, err}
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// withStderr adds what git printed on stderr to the error of a failed
+// command
+func withStderr(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if msg := strings.TrimSpace(string(exitErr.Stderr)); msg != "" {
+			return fmt.Errorf("%v: %s", err, Redact(msg))
+		}
+	}
+	return err
+}
+
+// Resolve returns the commit of rev, a tag or a commit, in the
+// repository at dir
+func Resolve(dir, rev string) (string, error) {
+	commit, ok := verify(dir, rev)
+	if !ok {
+		return "", &Error{"rev-parse", fmt.Errorf("unknown revision %s", rev)}
+	}
+	return commit, nil
+}
+
+// commitRe matches a full commit id
+var commitRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// ResolveRemote returns the commit of rev, a branch, tag or commit, in the
+// repository at url without cloning it. A full commit id is returned as is.
+func ResolveRemote(url, rev string) (string, error) {
+	if commitRe.MatchString(rev) {
+		return rev, nil
+	}
+	env, err := authEnv(url)
+	if err != nil {
+		return "", &Error{"ls-remote", err}
+	}
+	out, err := runEnv("", env, "ls-remote", "ls-remote", url, rev, rev+"^{}")
+	if err != nil {
+		return "", err
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if f := strings.Fields(line); len(f) == 2 {
+			refs[f[1]] = f[0]
+		}
+	}
+	// An annotated tag is peeled to the commit it tags
+	for _, ref := range []string{"refs/tags/" + rev + "^{}", "refs/tags/" + rev, "refs/heads/" + rev} {
+		if commit, ok := refs[ref]; ok {
+			return commit, nil
+		}
+	}
+	return "", &Error{"ls-remote", fmt.Errorf("unknown revision %s in %s", rev, Redact(url))}
+}
+
+// HasRevision returns true if rev, a branch of origin, a tag or a commit,
+// can be checked out in the repository at dir without fetching
+func HasRevision(dir, rev string) bool {
+	if _, ok := verify(dir, "refs/remotes/origin/"+rev); ok {
+		return true
+	}
+	_, ok := verify(dir, rev)
+	return ok
 }
 
-// Pull the repository at the current workdir.
-// example err := git.Pull()
-func Pull() error {
-	var (
-		err error
-	)
-	log.Printf("git pull")
-	if _, err = exec.Command("git", "pull").Output(); err != nil {
-		log.Printf("Error pulling: %v", err)
+// verify returns the commit of ref, if it exists
+func verify(dir, ref string) (string, bool) {
+	cmd := exec.Command("git", "rev-parse", "-q", "--verify", ref+"^{commit}")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err == nil
+}
+
+// IsDirty returns true if tracked files in the repository at dir have been
+// modified. Untracked files are not considered, checkouts leave them be.
+func IsDirty(dir string) (bool, error) {
+	out, err := run(dir, "status", "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return false, err
+	}
+	return out != "", nil
+}
+
+// DiffHash returns a hash of the uncommitted changes in the repository at
+// dir, untracked files included, or "" if there are none
+func DiffHash(dir string) (string, error) {
+	diff, err := run(dir, "diff", "diff", "HEAD", "--binary")
+	if err != nil {
+		return "", err
+	}
+	untracked, err := run(dir, "ls-files", "ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return "", err
+	}
+	if diff == "" && untracked == "" {
+		return "", nil
+	}
+	h := sha256.New()
+	io.WriteString(h, diff)
+	for _, name := range strings.Split(untracked, "\x00") {
+		if name == "" {
+			continue
+		}
+		sum, err := utils.HashFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s\n", sum, name)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func isAncestor(dir, ancestor, commit string) bool {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", ancestor, commit)
+	cmd.Dir = dir
+	return cmd.Run() == nil
+}
+
+// Fetch fetches the branches and tags of origin into the repository at
+// dir, also for clones limited to a single branch. If rev is not found
+// afterwards it is fetched by name, to get commits outside the branches.
+func Fetch(dir, rev string) error {
+	url, err := run(dir, "remote", "remote", "get-url", "origin")
+	if err != nil {
 		return err
 	}
-	return nil
+	env, err := authEnv(url)
+	if err != nil {
+		return &Error{"fetch", err}
+	}
+	if _, err = runEnv(dir, env, "fetch", "fetch", "-q", "--tags", "--prune", "origin", "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+		return err
+	}
+	if _, ok := verify(dir, rev); rev == "" || ok {
+		return nil
+	}
+	_, err = runEnv(dir, env, "fetch", "fetch", "-q", "origin", rev)
+	return err
 }
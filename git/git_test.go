@@ -0,0 +1,194 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package git
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitIn runs git in dir and returns its output
+func gitIn(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t",
+		"GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// testRepo creates a repository with two commits on master, a tag v1 on
+// the first one and a branch dev. It returns its path and the commits.
+func testRepo(t *testing.T, dir string) (string, []string) {
+	t.Helper()
+	repo := filepath.Join(dir, "origin")
+	git := func(args ...string) string {
+		t.Helper()
+		return gitIn(t, repo, args...)
+	}
+	if err := os.MkdirAll(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+	git("init", "-q", "-b", "master")
+	var commits []string
+	for _, content := range []string{"one", "two"} {
+		if err := ioutil.WriteFile(filepath.Join(repo, "file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "file")
+		git("commit", "-q", "-m", content)
+		commits = append(commits, git("rev-parse", "HEAD"))
+	}
+	git("tag", "v1", commits[0])
+	git("branch", "dev", commits[0])
+	return repo, commits
+}
+
+func TestClone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcb-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo, commits := testRepo(t, dir)
+
+	tests := []struct {
+		rev     string
+		commit  string
+		content string
+	}{
+		{"master", commits[1], "two"},
+		{"dev", commits[0], "one"},
+		{"v1", commits[0], "one"},
+		{commits[0], commits[0], "one"},
+	}
+	for i, tt := range tests {
+		dst := filepath.Join(dir, "clone", strings.Repeat("x", i+1))
+		commit, err := Clone(repo, dst, tt.rev)
+		if err != nil {
+			t.Errorf("Clone(%s): %v", tt.rev, err)
+			continue
+		}
+		if commit != tt.commit {
+			t.Errorf("Clone(%s) = %s, want %s", tt.rev, commit, tt.commit)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dst, "file"))
+		if err != nil || string(content) != tt.content {
+			t.Errorf("Clone(%s) checked out %q, %v, want %q", tt.rev, content, err, tt.content)
+		}
+		if dirty, err := IsDirty(dst); err != nil || dirty {
+			t.Errorf("Clone(%s) left a dirty tree: %t, %v", tt.rev, dirty, err)
+		}
+		// The clone must also be usable by Update
+		if _, err = Update(dst, "master"); err != nil {
+			t.Errorf("Update after Clone(%s): %v", tt.rev, err)
+		}
+	}
+}
+
+func TestCloneUnknownRevision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcb-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo, _ := testRepo(t, dir)
+
+	dst := filepath.Join(dir, "clone")
+	if _, err = Clone(repo, dst, "nosuch"); err == nil {
+		t.Fatal("Clone of an unknown revision succeeded")
+	}
+	if _, err = os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("a failed clone was left behind: %v", err)
+	}
+}
+
+// testClone clones master of a test repository, for checking out other
+// revisions in it
+func testClone(t *testing.T) (string, []string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tcb-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	repo, commits := testRepo(t, dir)
+	dst := filepath.Join(dir, "clone")
+	if _, err = Clone(repo, dst, "master"); err != nil {
+		t.Fatal(err)
+	}
+	return dst, commits
+}
+
+// checkRefused checks that err is a DirtyError and that HEAD of dir is
+// still head
+func checkRefused(t *testing.T, op string, err error, dir, head string) {
+	t.Helper()
+	var dirty *DirtyError
+	if !errors.As(err, &dirty) {
+		t.Errorf("%s = %v, want a DirtyError", op, err)
+	}
+	if got := gitIn(t, dir, "rev-parse", "HEAD"); got != head {
+		t.Errorf("%s moved HEAD to %s, want %s", op, got, head)
+	}
+}
+
+func TestCheckoutLocalModifications(t *testing.T) {
+	dst, commits := testClone(t)
+	file := filepath.Join(dst, "file")
+	if err := ioutil.WriteFile(file, []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Checkout(dst, "v1")
+	checkRefused(t, "Checkout(v1)", err, dst, commits[1])
+	_, err = Update(dst, "dev")
+	checkRefused(t, "Update(dev)", err, dst, commits[1])
+	if content, err := ioutil.ReadFile(file); err != nil || string(content) != "modified" {
+		t.Errorf("the modification was lost: %q, %v", content, err)
+	}
+}
+
+func TestCheckoutUnpushedCommits(t *testing.T) {
+	dst, _ := testClone(t)
+	if err := ioutil.WriteFile(filepath.Join(dst, "file"), []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitIn(t, dst, "commit", "-q", "-a", "-m", "local")
+	local := gitIn(t, dst, "rev-parse", "HEAD")
+
+	_, err := Checkout(dst, "master")
+	checkRefused(t, "Checkout(master)", err, dst, local)
+	_, err = Update(dst, "master")
+	checkRefused(t, "Update(master)", err, dst, local)
+	if got := gitIn(t, dst, "rev-parse", "refs/heads/master"); got != local {
+		t.Errorf("the local commit was dropped from master, it is at %s", got)
+	}
+}
@@ -22,39 +22,34 @@ package utils
 
 import (
 	"io"
-	"log"
 	"os"
 )
 
-// PathExists returns true if the path exists
+// PathExists returns true if the path exists. A path that can't be
+// examined, e.g. for lack of permissions, is reported as existing, so the
+// real error surfaces when it is used.
 func PathExists(path string) bool {
 	_, err := os.Stat(path)
-	if err == nil {
-		return true
-	}
-	if os.IsNotExist(err) {
-		return false
-	}
-	log.Fatalf("PathExists failed")
-	return false
+	return err == nil || !os.IsNotExist(err)
 }
 
-// CopyFile copies a file from dst to src. If file exists
-func CopyFile(src, dst string) {
+// CopyFile copies a file from src to dst. If dst exists it is overwritten.
+func CopyFile(src, dst string) error {
 	var (
 		srcFile, dstFile *os.File
 		err              error
 	)
 	if srcFile, err = os.Open(src); err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer srcFile.Close()
 
 	if dstFile, err = os.Create(dst); err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer dstFile.Close()
 	if _, err = io.Copy(dstFile, srcFile); err != nil {
-		log.Fatal(err)
+		dstFile.Close()
+		return err
 	}
+	return dstFile.Close()
 }
@@ -0,0 +1,169 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package workspace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// The lock file inside the workspace
+const lockFile = ".busy"
+
+// How often a waiting tcb checks if the lock has been released
+var lockPollInterval = 2 * time.Second
+
+// LockInfo tells who holds the workspace lock
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	Since   time.Time `json:"since"`
+}
+
+// BusyError is returned when another tcb holds the workspace lock
+type BusyError struct {
+	Info LockInfo
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("workspace busy (pid %d on %s, command %q, since %s)",
+		e.Info.PID, e.Info.Host, e.Info.Command, e.Info.Since.Format(time.RFC1123))
+}
+
+// The open lock file while this process holds the lock
+var lockHandle *os.File
+
+// Lock takes the advisory lock of the workspace, so two tcb processes can't
+// build in it at the same time. command is recorded in the lock to tell
+// others who is using the workspace. If wait is set Lock blocks until the
+// lock is released, otherwise it returns a BusyError. The lock is held on
+// the open lock file, so the operating system releases it when a tcb
+// process dies and there are no stale locks to clean up.
+func Lock(command string, wait bool) error {
+	if lockHandle != nil {
+		return nil
+	}
+	host, _ := os.Hostname()
+	info := LockInfo{PID: os.Getpid(), Host: host, Command: command, Since: time.Now()}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	waiting := false
+	for {
+		f, err := os.OpenFile(Path(lockFile), os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return &Error{"lock", Path(lockFile), err}
+		}
+		ok, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return &Error{"lock", Path(lockFile), err}
+		}
+		if ok {
+			// The previous holder may have removed the file after we
+			// opened it, in which case the lock is on a file nobody
+			// else sees. Start over on the one at the path.
+			if !isLockFile(f) {
+				f.Close()
+				continue
+			}
+			if err = writeLock(f, b); err != nil {
+				f.Close()
+				return &Error{"lock", Path(lockFile), err}
+			}
+			lockHandle = f
+			return nil
+		}
+		f.Close()
+
+		busy := &BusyError{Info: readLock()}
+		if !wait {
+			return busy
+		}
+		if !waiting {
+			log.Printf("Waiting for %v", busy)
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// isLockFile returns true if f is the file currently at the lock path
+func isLockFile(f *os.File) bool {
+	st, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pst, err := os.Stat(Path(lockFile))
+	return err == nil && os.SameFile(st, pst)
+}
+
+// writeLock replaces the content of the lock file with info
+func writeLock(f *os.File, info []byte) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt(info, 0)
+	return err
+}
+
+// readLock returns the holder of the lock. A holder that has not written
+// the lock yet is returned as an unknown command.
+func readLock() LockInfo {
+	var info LockInfo
+	b, err := ioutil.ReadFile(Path(lockFile))
+	if err == nil && json.Unmarshal(b, &info) == nil {
+		return info
+	}
+	info = LockInfo{Command: "unknown"}
+	if st, err := os.Stat(Path(lockFile)); err == nil {
+		info.Since = st.ModTime()
+	}
+	return info
+}
+
+// Unlock releases the workspace lock, if this process holds it
+func Unlock() error {
+	if lockHandle == nil {
+		return nil
+	}
+	f := lockHandle
+	lockHandle = nil
+	// Remove the file while still holding the lock. Anyone who opened it
+	// before that finds it is no longer the lock file once they get it.
+	// Windows doesn't remove open files, there it is left empty instead.
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return &Error{"unlock", Path(lockFile), err}
+	}
+	os.Remove(Path(lockFile))
+	if err := f.Close(); err != nil {
+		return &Error{"unlock", Path(lockFile), err}
+	}
+	return nil
+}
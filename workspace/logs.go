@@ -0,0 +1,186 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package workspace
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logs are named by the time the run started
+const logTimeFormat = "20060102-150405.000"
+
+// The last line of a finished log starts with this
+const logTrailer = "--- tcb: finished"
+
+// Run statuses as reported by LogRun.Status
+const (
+	LogRunning = "running"
+	LogOK      = "ok"
+	LogFailed  = "failed"
+)
+
+// Log is the output of one run, kept in logs/<name>/<timestamp>.log. It is
+// safe to write to it from several goroutines.
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	Path string
+}
+
+// The first line of a log names the tcb process writing it
+var logHeaderRe = regexp.MustCompile(`^--- tcb: .*, pid (\d+) on (\S*)$`)
+
+// LogRun describes a log written by an earlier run
+type LogRun struct {
+	Path    string
+	Started time.Time
+	Status  string
+	// PID and Host tell which tcb process wrote the log. Logs of older
+	// versions of tcb don't have them.
+	PID  int
+	Host string
+}
+
+// WriterAlive returns true if the tcb process writing the log of the run
+// may still be running. When that can't be told, because the run is on
+// another host or its log doesn't say, it is taken to be.
+func (r *LogRun) WriterAlive() bool {
+	host, _ := os.Hostname()
+	if r.PID == 0 || r.Host != host {
+		return true
+	}
+	return processAlive(r.PID)
+}
+
+// OpenLog creates a new log for name, which is a target or another thing
+// tcb builds. Only the keep most recent logs of name are kept, older ones
+// are removed. A keep of zero or less keeps all logs.
+func OpenLog(name, title string, keep int) (*Log, error) {
+	if err := MakeDir(0777, "logs", name); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	path := Path("logs", name, now.Format(logTimeFormat)+".log")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, &Error{"create log", path, err}
+	}
+	l := &Log{f: f, Path: path}
+	host, _ := os.Hostname()
+	fmt.Fprintf(l, "--- tcb: %s, started %s, pid %d on %s\n", title, now.Format(time.RFC1123), os.Getpid(), host)
+
+	if keep > 0 {
+		runs, err := Logs(name)
+		if err != nil {
+			return l, err
+		}
+		for len(runs) > keep {
+			if err = os.Remove(runs[0].Path); err != nil {
+				return l, &Error{"rotate log", runs[0].Path, err}
+			}
+			runs = runs[1:]
+		}
+	}
+	return l, nil
+}
+
+func (l *Log) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// Finish records the outcome of the run and closes the log
+func (l *Log) Finish(runErr error) error {
+	status := LogOK
+	if runErr != nil {
+		status = fmt.Sprintf("%s: %v", LogFailed, runErr)
+	}
+	fmt.Fprintf(l, "%s %s, status %s\n", logTrailer, time.Now().Format(time.RFC1123), status)
+	return l.f.Close()
+}
+
+// Logs returns the logs of name, oldest first
+func Logs(name string) ([]LogRun, error) {
+	var runs []LogRun
+	files, err := ioutil.ReadDir(Path("logs", name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, &Error{"list logs", Path("logs", name), err}
+	}
+	for _, f := range files {
+		started, err := time.ParseInLocation(logTimeFormat, strings.TrimSuffix(f.Name(), ".log"), time.Local)
+		if err != nil || !strings.HasSuffix(f.Name(), ".log") {
+			continue
+		}
+		path := filepath.Join(Path("logs", name), f.Name())
+		run := LogRun{Path: path, Started: started}
+		run.Status, run.PID, run.Host = readLogInfo(path)
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+	return runs, nil
+}
+
+// LogFinished returns true if line is the last line of a log
+func LogFinished(line string) bool {
+	return strings.HasPrefix(line, logTrailer)
+}
+
+// readLogInfo reads the status from the trailer of a log, and the process
+// writing it from its header
+func readLogInfo(path string) (status string, pid int, host string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return LogRunning, 0, ""
+	}
+	defer f.Close()
+	last := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if last == "" {
+			if m := logHeaderRe.FindStringSubmatch(scanner.Text()); m != nil {
+				pid, _ = strconv.Atoi(m[1])
+				host = m[2]
+			}
+		}
+		last = scanner.Text()
+	}
+	switch {
+	case !LogFinished(last):
+		return LogRunning, pid, host
+	case strings.Contains(last, "status "+LogOK):
+		return LogOK, pid, host
+	}
+	return LogFailed, pid, host
+}
@@ -0,0 +1,70 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package workspace
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLogWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcb-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldWd := Wd
+	Wd = dir
+	defer func() { Wd = oldWd }()
+
+	l, err := OpenLog("target", "bitbake image", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs, err := Logs("target")
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("Logs = %v, %v", runs, err)
+	}
+	if r := runs[0]; r.Status != LogRunning || r.PID != os.Getpid() || !r.WriterAlive() {
+		t.Errorf("running log: %+v, alive %t", r, r.WriterAlive())
+	}
+	if err = l.Finish(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A log left behind by a process that is gone
+	host, _ := os.Hostname()
+	header := fmt.Sprintf("--- tcb: bitbake image, started x, pid %d on %s\n", 1<<30, host)
+	if err = ioutil.WriteFile(Path("logs", "target", "20990101-000000.000.log"), []byte(header), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if runs, err = Logs("target"); err != nil || len(runs) != 2 {
+		t.Fatalf("Logs = %v, %v", runs, err)
+	}
+	if r := runs[0]; r.Status != LogOK || r.PID != os.Getpid() {
+		t.Errorf("finished log: %+v", r)
+	}
+	if r := runs[1]; r.Status != LogRunning || r.WriterAlive() {
+		t.Errorf("abandoned log: %+v, alive %t", r, r.WriterAlive())
+	}
+}
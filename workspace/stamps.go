@@ -0,0 +1,132 @@
+// Copyright © 2017 Staffan Olsson <staffano@diversum.nu>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package workspace
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/staffano/tcb/utils"
+)
+
+// StampStatus tells if an entity needs to be (re)built
+type StampStatus int
+
+const (
+	// StampMissing means the entity has never been built
+	StampMissing StampStatus = iota
+	// StampStale means the entity was built from other inputs
+	StampStale
+	// StampValid means the entity is up to date
+	StampValid
+)
+
+// Stamp records the inputs an entity was built from. Each input is a
+// name mapped to a hash (or revision) of its contents. Info holds facts
+// about the build that don't affect the result, like where it ran, and
+// is not part of the digest.
+type Stamp struct {
+	Digest string            `json:"digest"`
+	Inputs map[string]string `json:"inputs"`
+	Info   map[string]string `json:"info,omitempty"`
+}
+
+// NewStamp creates a stamp for the inputs, with a digest covering all
+// of them.
+func NewStamp(inputs map[string]string) *Stamp {
+	var names []string
+	for n := range inputs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, n := range names {
+		b.WriteString(n + "=" + inputs[n] + "\n")
+	}
+	return &Stamp{Digest: utils.HashString(b.String()), Inputs: inputs}
+}
+
+// SetStamp creates/updates the stamp file for entity
+func SetStamp(entity string, stamp *Stamp) error {
+	if err := MakeDir(0777, "stamps"); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(stamp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(Path("stamps", entity), b, 0666); err != nil {
+		return &Error{"write stamp", Path("stamps", entity), err}
+	}
+	return nil
+}
+
+// ReadStamp returns the recorded stamp of entity, or nil if there is none.
+// Stamps written by older versions of tcb are empty and read as nil.
+func ReadStamp(entity string) *Stamp {
+	b, err := ioutil.ReadFile(Path("stamps", entity))
+	if err != nil {
+		return nil
+	}
+	var stamp Stamp
+	if err = json.Unmarshal(b, &stamp); err != nil {
+		return nil
+	}
+	return &stamp
+}
+
+// GetStamp compares the stamp of entity with the current inputs
+func GetStamp(entity string, inputs map[string]string) StampStatus {
+	if !PathExists("stamps", entity) {
+		return StampMissing
+	}
+	old := ReadStamp(entity)
+	if old == nil {
+		log.Printf("Stamp %s has no recorded inputs, treating it as stale", entity)
+		return StampStale
+	}
+	if old.Digest == NewStamp(inputs).Digest {
+		return StampValid
+	}
+	for n, v := range inputs {
+		if old.Inputs[n] != v {
+			log.Printf("Stamp %s is stale, %s changed", entity, n)
+		}
+	}
+	for n := range old.Inputs {
+		if _, ok := inputs[n]; !ok {
+			log.Printf("Stamp %s is stale, %s was removed", entity, n)
+		}
+	}
+	return StampStale
+}
+
+// RemoveStamp deletes the stamp file from the stamp directory.
+func RemoveStamp(entity string) error {
+	if err := os.Remove(Path("stamps", entity)); err != nil && !os.IsNotExist(err) {
+		return &Error{"remove stamp", Path("stamps", entity), err}
+	}
+	return nil
+}
@@ -21,6 +21,7 @@
 package workspace
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path"
@@ -35,21 +36,39 @@ var Wd string
 var pathStack = make([]string, 23)
 var pathStackIdx = 0
 
+// Error is returned when an operation on the workspace fails
+type Error struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("workspace: %s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 // InitWorkspace assumes the Wd variable has been set as it will
 // try to make sure the workspace exists.
-func InitWorkspace() {
+func InitWorkspace() error {
 
 	var (
 		err error
 	)
 	if !PathExists("") {
 		if err = os.Mkdir(Wd, 0777); err != nil {
-			log.Fatalf("Could not create the workspace directory: %s", Wd)
+			return &Error{"create", Wd, err}
 		}
 		log.Printf("Created workspace directory %s", Wd)
 	}
-	ResetPathStack()
+	if err = ResetPathStack(); err != nil {
+		return err
+	}
 	log.Printf("Workspace initialized at %s", Wd)
+	return nil
 }
 
 // Path returns a path within the workspace
@@ -73,88 +92,67 @@ func PathExists(elem ...string) bool {
 
 // CWD sets the current working directory as used by the operations
 // in the os package.
-func cwd(elem ...string) {
+func cwd(elem ...string) error {
 	truePath := Path(elem...)
-	if PathExists(elem...) != true {
-		log.Fatalf("Cant set CWD to a non-existing workspace path. [%s]", truePath)
-	}
 	if err := os.Chdir(truePath); err != nil {
-		log.Fatalf("Error calling os.Chdir on path %s", truePath)
+		return &Error{"chdir", truePath, err}
 	}
 	log.Printf("Chdir to %s", truePath)
+	return nil
 }
 
 // ResetPathStack invalidates any active push/pops and sets the current working
 // directory to Wd
-func ResetPathStack() {
+func ResetPathStack() error {
 	pathStackIdx = 0
-	cwd("")
+	return cwd("")
 }
 
 // Push changes the current directory and sets the argument as the
 // new current directory within the workspace
-func Push(elem ...string) {
+func Push(elem ...string) error {
 	var (
 		cd  string
 		err error
 	)
 	if cd, err = os.Getwd(); err != nil {
-		log.Fatalf("Could not retrieve current directory")
+		return &Error{"getwd", "", err}
+	}
+	if err = cwd(elem...); err != nil {
+		return err
 	}
 	pathStack[pathStackIdx] = cd
 	pathStackIdx++
-	cwd(elem...)
+	return nil
 }
 
 // Pop returns to the previous current directory in the stack
-func Pop() {
+func Pop() error {
 	if pathStackIdx == 0 {
-		log.Fatalf("Trying to pop from an empty Path Stack")
+		return &Error{"pop", "", fmt.Errorf("the path stack is empty")}
 	}
 	pathStackIdx--
 	nd := pathStack[pathStackIdx]
 	if err := os.Chdir(nd); err != nil {
-		log.Fatalf("Could not pop the current working dir to %s", nd)
+		return &Error{"chdir", nd, err}
 	}
 	log.Printf("Chdir to %s", nd)
+	return nil
 }
 
 // MakeDir creates a directory structure inside the workspace
-func MakeDir(permission os.FileMode, elem ...string) {
+func MakeDir(permission os.FileMode, elem ...string) error {
 	truePath := Path(elem...)
 	if err := os.MkdirAll(truePath, permission); err != nil {
-		log.Fatalf("Could not create path %v", truePath)
-	}
-}
-
-// SetStamp creates/updates the stamp file for entity
-func SetStamp(entity string) {
-	var (
-		err error
-		fd  *os.File
-	)
-	MakeDir(0777, "stamps")
-	if fd, err = os.Create(Path("stamps", entity)); err != nil {
-		log.Fatalf("Error trying to create stamp file %s", (Path("stamps", entity)))
-	}
-	defer fd.Close()
-}
-
-// GetStamp returns true if the stamp is set
-func GetStamp(entity string) bool {
-	return PathExists("stamps", entity)
-}
-
-// RemoveStamp deletes the stamp file from the stamp directory.
-func RemoveStamp(entity string) {
-	if err := os.Remove(Path("stamps", entity)); err != nil {
-		log.Fatalf("Error trying to remove stamp file %s", (Path("stamps", entity)))
+		return &Error{"mkdir", truePath, err}
 	}
+	return nil
 }
 
 // Reset the workspace. Removing all files and also the directory
-func Reset() {
+func Reset() error {
 	if err := os.RemoveAll(Wd); err != nil {
-		log.Fatalf("Error resetting workdir %s, %v", Wd, err)
+		return &Error{"reset", Wd, err}
 	}
+	return nil
 }